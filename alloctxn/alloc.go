@@ -0,0 +1,108 @@
+package alloctxn
+
+import (
+	"sync"
+)
+
+//
+// Alloc is the block allocator.  Like go-journal's alloc.Alloc, it
+// allocates and frees numbers in a bitmap, bit 0 for number 0 and so
+// on, handing out free numbers in increasing order from where the last
+// allocation stopped.  It also allocates several numbers at once, under
+// its lock, so that concurrent allocations don't break up a run.
+//
+
+type Alloc struct {
+	mu     *sync.Mutex
+	next   uint64 // first number to try
+	bitmap []byte
+}
+
+// MkAlloc initializes with a bitmap, whose 0 bits are free numbers and
+// 1 bits are numbers in use
+func MkAlloc(bitmap []byte) *Alloc {
+	return &Alloc{
+		mu:     new(sync.Mutex),
+		next:   0,
+		bitmap: bitmap,
+	}
+}
+
+func (a *Alloc) incNext() uint64 {
+	a.next = a.next + 1
+	if a.next >= uint64(len(a.bitmap)*8) {
+		a.next = 0
+	}
+	return a.next
+}
+
+// allocBit claims a free number, or returns 0 if there is none.
+// Assumes caller holds mu.
+func (a *Alloc) allocBit() uint64 {
+	num := a.incNext()
+	start := num
+	for {
+		if a.bitmap[num/8]&(1<<(num%8)) == 0 {
+			a.bitmap[num/8] = a.bitmap[num/8] | (1 << (num % 8))
+			return num
+		}
+		num = a.incNext()
+		if num == start {
+			return 0
+		}
+	}
+}
+
+// AllocNum returns a free number, or 0 if there is none
+func (a *Alloc) AllocNum() uint64 {
+	a.mu.Lock()
+	num := a.allocBit()
+	a.mu.Unlock()
+	return num
+}
+
+// AllocNums returns up to n free numbers, fewer if the bitmap fills up.
+// They form a run unless the allocator runs into numbers in use.
+func (a *Alloc) AllocNums(n uint64) []uint64 {
+	nums := make([]uint64, 0, n)
+	a.mu.Lock()
+	for uint64(len(nums)) < n {
+		num := a.allocBit()
+		if num == 0 {
+			break
+		}
+		nums = append(nums, num)
+	}
+	a.mu.Unlock()
+	return nums
+}
+
+func (a *Alloc) FreeNum(num uint64) {
+	if num == 0 {
+		panic("FreeNum")
+	}
+	a.mu.Lock()
+	a.bitmap[num/8] = a.bitmap[num/8] & ^(1 << (num % 8))
+	a.mu.Unlock()
+}
+
+func popCnt(b byte) uint64 {
+	var count uint64
+	var x = b
+	for i := uint64(0); i < 8; i++ {
+		count += uint64(x & 1)
+		x = x >> 1
+	}
+	return count
+}
+
+func (a *Alloc) NumFree() uint64 {
+	a.mu.Lock()
+	total := 8 * uint64(len(a.bitmap))
+	var count uint64
+	for _, b := range a.bitmap {
+		count += popCnt(b)
+	}
+	a.mu.Unlock()
+	return total - count
+}
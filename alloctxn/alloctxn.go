@@ -1,6 +1,8 @@
 package alloctxn
 
 import (
+	"github.com/tchajed/goose/machine/disk"
+
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/alloc"
 	"github.com/mit-pdos/go-journal/buf"
@@ -19,28 +21,50 @@ import (
 type AllocTxn struct {
 	Super      *super.FsSuper
 	Op         *jrnl.Op
-	Balloc     *alloc.Alloc
+	Balloc     *Alloc
 	Ialloc     *alloc.Alloc
+	Bcount     *Counter
+	Icount     *Counter
 	allocInums []common.Inum
 	freeInums  []common.Inum
 	allocBnums []common.Bnum
 	freeBnums  []common.Bnum
+	bitmap     map[common.Bnum]bool // bitmap blocks that PreCommit writes
+	Freed      *Freed
+	direct     map[common.Bnum]bool // new blocks written directly to disk
 }
 
-func Begin(super *super.FsSuper, log *obj.Log, balloc *alloc.Alloc, ialloc *alloc.Alloc) *AllocTxn {
+func Begin(super *super.FsSuper, log *obj.Log, balloc *Alloc, ialloc *alloc.Alloc,
+	bcount *Counter, icount *Counter, freed *Freed) *AllocTxn {
 	atxn := &AllocTxn{
 		Super:      super,
 		Op:         jrnl.Begin(log),
 		Ialloc:     ialloc,
 		Balloc:     balloc,
+		Bcount:     bcount,
+		Icount:     icount,
 		allocInums: make([]common.Inum, 0),
 		freeInums:  make([]common.Inum, 0),
 		allocBnums: make([]common.Bnum, 0),
 		freeBnums:  make([]common.Bnum, 0),
+		bitmap:     make(map[common.Bnum]bool),
+		Freed:      freed,
+		direct:     make(map[common.Bnum]bool),
 	}
 	return atxn
 }
 
+// NDirty returns the # blocks the transaction writes, including the
+// bitmap blocks of the allocated and freed numbers
+func (atxn *AllocTxn) NDirty() uint64 {
+	return atxn.Op.NDirty() + uint64(len(atxn.bitmap))
+}
+
+// markBitmap records that n's bit in the bitmap starting at blk changes
+func (atxn *AllocTxn) markBitmap(blk common.Bnum, n uint64) {
+	atxn.bitmap[blk+common.Bnum(n/common.NBITBLOCK)] = true
+}
+
 // Id returns a pointer to the Op for debug printing only
 func (atxn *AllocTxn) Id() *jrnl.Op {
 	return atxn.Op
@@ -51,6 +75,8 @@ func (atxn *AllocTxn) AllocINum() common.Inum {
 	util.DPrintf(1, "AllocINum -> # %v\n", inum)
 	if inum != common.NULLINUM {
 		atxn.allocInums = append(atxn.allocInums, inum)
+		atxn.markBitmap(atxn.Super.BitmapInodeStart(), uint64(inum))
+		atxn.Icount.dec(1)
 	}
 	return inum
 }
@@ -58,6 +84,7 @@ func (atxn *AllocTxn) AllocINum() common.Inum {
 func (atxn *AllocTxn) FreeINum(inum common.Inum) {
 	util.DPrintf(1, "FreeINum -> # %v\n", inum)
 	atxn.freeInums = append(atxn.freeInums, inum)
+	atxn.markBitmap(atxn.Super.BitmapInodeStart(), uint64(inum))
 }
 
 func (atxn *AllocTxn) WriteBits(nums []uint64, blk uint64, alloc bool) {
@@ -89,12 +116,15 @@ func (atxn *AllocTxn) PreCommit() {
 // On-disk bitmap has been updated; update in-memory state for free bits
 func (atxn *AllocTxn) PostCommit() {
 	util.DPrintf(1, "updateFree: inums %v blks %v\n", atxn.freeInums, atxn.freeBnums)
+	atxn.Freed.free(atxn.freeBnums)
 	for _, inum := range atxn.freeInums {
 		atxn.Ialloc.FreeNum(uint64(inum))
 	}
 	for _, bn := range atxn.freeBnums {
 		atxn.Balloc.FreeNum(bn)
 	}
+	atxn.Icount.inc(uint64(len(atxn.freeInums)))
+	atxn.Bcount.inc(uint64(len(atxn.freeBnums)))
 }
 
 // Abort: free allocated inums and bnums. Nothing to do for freed
@@ -107,6 +137,8 @@ func (atxn *AllocTxn) PostAbort() {
 	for _, bn := range atxn.allocBnums {
 		atxn.Balloc.FreeNum(bn)
 	}
+	atxn.Icount.inc(uint64(len(atxn.allocInums)))
+	atxn.Bcount.inc(uint64(len(atxn.allocBnums)))
 }
 
 func (atxn *AllocTxn) AssertValidBlock(blkno common.Bnum) {
@@ -117,25 +149,58 @@ func (atxn *AllocTxn) AssertValidBlock(blkno common.Bnum) {
 	}
 }
 
-func (atxn *AllocTxn) AllocBlock() common.Bnum {
-	util.DPrintf(5, "alloc block\n")
-	bn := common.Bnum(atxn.Balloc.AllocNum())
+// allocated records that the transaction allocated bn
+func (atxn *AllocTxn) allocated(bn common.Bnum) {
 	atxn.AssertValidBlock(bn)
 	util.DPrintf(1, "alloc block -> %v\n", bn)
+	atxn.allocBnums = append(atxn.allocBnums, bn)
+	atxn.markBitmap(atxn.Super.BitmapBlockStart(), uint64(bn))
+}
+
+func (atxn *AllocTxn) allocBlock() common.Bnum {
+	util.DPrintf(5, "alloc block\n")
+	bn := common.Bnum(atxn.Balloc.AllocNum())
 	if bn != common.NULLBNUM {
-		atxn.allocBnums = append(atxn.allocBnums, bn)
+		atxn.allocated(bn)
+		atxn.Bcount.dec(1)
 	}
 	return bn
 }
 
+// AllocBlock allocates a block and zeroes it; freed blocks aren't
+// zeroed, so that freeing doesn't log their contents.
+func (atxn *AllocTxn) AllocBlock() common.Bnum {
+	bn := atxn.allocBlock()
+	if bn != common.NULLBNUM {
+		atxn.ZeroBlock(bn)
+	}
+	return bn
+}
+
+// AllocBlocks allocates up to n blocks, fewer if the disk fills up,
+// without zeroing them; the caller must write or zero each block.
+// The blocks form a contiguous run unless Balloc runs into blocks in
+// use.
+func (atxn *AllocTxn) AllocBlocks(n uint64) []common.Bnum {
+	nums := atxn.Balloc.AllocNums(n)
+	bns := make([]common.Bnum, 0, len(nums))
+	for _, num := range nums {
+		bn := common.Bnum(num)
+		atxn.allocated(bn)
+		bns = append(bns, bn)
+	}
+	atxn.Bcount.dec(uint64(len(bns)))
+	return bns
+}
+
 func (atxn *AllocTxn) FreeBlock(blkno common.Bnum) {
 	util.DPrintf(1, "free block %v\n", blkno)
 	atxn.AssertValidBlock(blkno)
 	if blkno == 0 {
 		return
 	}
-	atxn.ZeroBlock(blkno)
 	atxn.freeBnums = append(atxn.freeBnums, blkno)
+	atxn.markBitmap(atxn.Super.BitmapBlockStart(), uint64(blkno))
 }
 
 func (atxn *AllocTxn) ReadBlock(blkno common.Bnum) *buf.Buf {
@@ -147,9 +212,31 @@ func (atxn *AllocTxn) ReadBlock(blkno common.Bnum) *buf.Buf {
 
 func (atxn *AllocTxn) ZeroBlock(blkno common.Bnum) {
 	util.DPrintf(5, "zero block %d\n", blkno)
-	buf := atxn.ReadBlock(blkno)
-	for i := range buf.Data {
-		buf.Data[i] = 0
+	atxn.WriteBlock(blkno, make([]byte, disk.BlockSize))
+}
+
+// MarkDirect marks blkno, which the transaction allocated with
+// AllocBlocks, to be written directly to disk instead of through the
+// log, if the file system bypasses the log and no write in the log may
+// still reach blkno (see Freed).  It returns whether it did; the caller
+// must then write all of blkno with WriteBlock before committing.
+func (atxn *AllocTxn) MarkDirect(blkno common.Bnum) bool {
+	if !atxn.Super.Bypass || atxn.Freed.has(blkno) {
+		return false
+	}
+	atxn.direct[blkno] = true
+	return true
+}
+
+// WriteBlock writes all of blkno, directly to disk if it is marked
+// direct.  The log writes a transaction's blocks and then issues a
+// barrier before writing the header that commits it, which makes the
+// direct writes durable before the metadata that points to them.
+func (atxn *AllocTxn) WriteBlock(blkno common.Bnum, data []byte) {
+	if atxn.direct[blkno] {
+		util.DPrintf(5, "write direct %d\n", blkno)
+		atxn.Super.Disk.Write(blkno, data)
+		return
 	}
-	buf.SetDirty()
+	atxn.Op.OverWrite(atxn.Super.Block2addr(blkno), common.NBITBLOCK, data)
 }
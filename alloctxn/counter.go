@@ -0,0 +1,48 @@
+package alloctxn
+
+import (
+	"sync"
+)
+
+//
+// Counter tracks how many of the numbers of an allocator are free, so
+// that FSSTAT doesn't have to scan the bitmap.  Like the in-memory
+// allocator, it counts a number as in use as soon as a transaction
+// allocates it, and as free once the transaction that frees it
+// commits.
+//
+
+type Counter struct {
+	mu    *sync.Mutex
+	total uint64
+	free  uint64
+}
+
+func MkCounter(total uint64, free uint64) *Counter {
+	return &Counter{
+		mu:    new(sync.Mutex),
+		total: total,
+		free:  free,
+	}
+}
+
+func (c *Counter) dec(n uint64) {
+	c.mu.Lock()
+	c.free = c.free - n
+	c.mu.Unlock()
+}
+
+func (c *Counter) inc(n uint64) {
+	c.mu.Lock()
+	c.free = c.free + n
+	c.mu.Unlock()
+}
+
+// Counts returns the total and free numbers
+func (c *Counter) Counts() (uint64, uint64) {
+	c.mu.Lock()
+	total := c.total
+	free := c.free
+	c.mu.Unlock()
+	return total, free
+}
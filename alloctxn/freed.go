@@ -0,0 +1,65 @@
+package alloctxn
+
+import (
+	"sync"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+//
+// Freed tracks the blocks that an older write in the log may still
+// reach.  Writing such a block directly to disk, bypassing the log,
+// isn't safe: the log may install the older write over the direct
+// write, and, if the block's free isn't durable yet, a crash brings
+// back the file that owned the block with the direct write's data in
+// it.
+//
+// The log doesn't say how far it has installed, so Freed never forgets
+// a block.  It holds the blocks that the log has to recover writes of
+// when the file system mounts, and all blocks that a transaction frees
+// after that.  Any other free block has no write in the log: the log
+// writes a block only once a transaction allocates it, and a
+// transaction must free the block again before anyone reuses it.
+//
+
+type Freed struct {
+	mu     *sync.Mutex
+	blocks map[common.Bnum]bool
+}
+
+// MkFreed makes the set for the log on d, before the log recovers
+func MkFreed(d disk.Disk) *Freed {
+	f := &Freed{
+		mu:     new(sync.Mutex),
+		blocks: make(map[common.Bnum]bool),
+	}
+	dec1 := marshal.NewDec(d.Read(wal.LOGHDR))
+	end := dec1.GetInt()
+	addrs := dec1.GetInts(wal.LOGSZ)
+	start := marshal.NewDec(d.Read(wal.LOGHDR2)).GetInt()
+	for pos := start; pos < end; pos++ {
+		f.blocks[common.Bnum(addrs[pos%wal.LOGSZ])] = true
+	}
+	return f
+}
+
+// free records that a committed transaction freed bns, before the
+// allocator may hand them out again
+func (f *Freed) free(bns []common.Bnum) {
+	f.mu.Lock()
+	for _, bn := range bns {
+		f.blocks[bn] = true
+	}
+	f.mu.Unlock()
+}
+
+func (f *Freed) has(bn common.Bnum) bool {
+	f.mu.Lock()
+	ok := f.blocks[bn]
+	f.mu.Unlock()
+	return ok
+}
@@ -73,13 +73,19 @@ func main() {
 	var diskfile string
 	flag.StringVar(&diskfile, "disk", "", "disk image (empty for MemDisk)")
 
+	var blockmap bool
+	flag.BoolVar(&blockmap, "blockmap", false, "map new files with block pointers instead of extents")
+
+	var bypass bool
+	flag.BoolVar(&bypass, "bypass", false, "write data of new blocks directly instead of through the log")
+
 	var dumpStats bool
 	flag.BoolVar(&dumpStats, "stats", false, "dump stats to stderr at end")
 
 	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
 	flag.Parse()
 
-	diskBlocks := 1500 + filesizeMegabytes*1024/4
+	diskBlocks := 2600 + filesizeMegabytes*1024/4
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -129,11 +135,11 @@ func main() {
 	}
 	server := go_nfs.MakeNfs(d)
 	server.Unstable = unstable
+	server.SetBlockMap(blockmap)
+	server.SetBypass(bypass)
 	defer server.ShutdownNfs()
 
-	srv := rfc1057.MakeServer()
-	srv.RegisterMany(nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(server))
-	srv.RegisterMany(nfstypes.NFS_PROGRAM_NFS_V3_regs(server))
+	srv := go_nfs.MkServer(server)
 
 	interruptSig := make(chan os.Signal, 1)
 	shutdown := false
@@ -1,39 +1,87 @@
 package dcache
 
 import (
+	"container/list"
+
 	"github.com/mit-pdos/go-journal/common"
 )
 
+//
+// A Dcache caches the entries of a directory, up to a fixed number of
+// entries; when full, it evicts the least-recently used entry.  A
+// lookup miss means that the name isn't in the directory only if the
+// cache is complete, i.e., it has never evicted an entry.
+//
+
 type Dentry struct {
 	Inum common.Inum
 	Off  uint64
 }
 
+type entry struct {
+	name   string
+	dentry Dentry
+}
+
 type Dcache struct {
-	cache   map[string]Dentry
-	Lastoff uint64
+	cache    map[string]*list.Element
+	lru      *list.List
+	sz       uint64
+	complete bool
+	Lastoff  uint64
 }
 
-func MkDcache() *Dcache {
+func MkDcache(sz uint64) *Dcache {
 	return &Dcache{
-		cache:   make(map[string]Dentry),
-		Lastoff: uint64(0),
+		cache:    make(map[string]*list.Element),
+		lru:      list.New(),
+		sz:       sz,
+		complete: true,
+		Lastoff:  uint64(0),
 	}
 }
 
+func (dc *Dcache) evict() {
+	e := dc.lru.Front()
+	dc.lru.Remove(e)
+	delete(dc.cache, e.Value.(*entry).name)
+	dc.complete = false
+}
+
 func (dc *Dcache) Add(name string, inum common.Inum, off uint64) {
-	dc.cache[name] = Dentry{Inum: inum, Off: off}
+	e, ok := dc.cache[name]
+	if ok {
+		e.Value.(*entry).dentry = Dentry{Inum: inum, Off: off}
+		dc.lru.MoveToBack(e)
+		return
+	}
+	if uint64(dc.lru.Len()) >= dc.sz {
+		dc.evict()
+	}
+	dc.cache[name] = dc.lru.PushBack(&entry{name: name,
+		dentry: Dentry{Inum: inum, Off: off}})
 }
 
 func (dc *Dcache) Lookup(name string) (Dentry, bool) {
-	d, ok := dc.cache[name]
-	return d, ok
+	e, ok := dc.cache[name]
+	if !ok {
+		return Dentry{}, false
+	}
+	dc.lru.MoveToBack(e)
+	return e.Value.(*entry).dentry, true
 }
 
 func (dc *Dcache) Del(name string) bool {
-	_, ok := dc.cache[name]
+	e, ok := dc.cache[name]
 	if ok {
+		dc.lru.Remove(e)
 		delete(dc.cache, name)
 	}
 	return ok
 }
+
+// Complete returns whether the cache holds all entries of the
+// directory
+func (dc *Dcache) Complete() bool {
+	return dc.complete
+}
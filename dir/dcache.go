@@ -1,6 +1,8 @@
 package dir
 
 import (
+	"github.com/tchajed/goose/machine/disk"
+
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-nfsd/dcache"
 	"github.com/mit-pdos/go-nfsd/fstxn"
@@ -8,18 +10,27 @@ import (
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
+// # entries cached per directory.  Only linear directories, which fit
+// in a block, have a dcache, and it is part of the in-memory inode, so
+// the inode cache bounds the total.
+const DCACHESZ uint64 = 64
+
 func mkDcache(dip *inode.Inode, op *fstxn.FsTxn) {
-	dip.Dcache = dcache.MkDcache()
-	Apply(dip, op, 0, dip.Size, 100000000,
-		func(ip *inode.Inode, name string, inum common.Inum, off uint64) {
-			dip.Dcache.Add(name, inum, off)
-		})
+	dip.Dcache = dcache.MkDcache(DCACHESZ)
+	linearApply(dip, op, 0, func(name string, inum common.Inum, off uint64) bool {
+		dip.Dcache.Add(name, inum, off)
+		return true
+	})
 }
 
 func LookupName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64) {
 	if dip.Kind != nfstypes.NF3DIR {
 		return common.NULLINUM, 0
 	}
+	if isIndexed(dip) {
+		inum := indexLookup(dip, op, name)
+		return inum, hashName(string(name))
+	}
 	var inum = common.NULLINUM
 	var finalOffset uint64 = 0
 	if dip.Dcache == nil {
@@ -29,14 +40,33 @@ func LookupName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (com
 	if ok {
 		inum = dentry.Inum
 		finalOffset = dentry.Off
+	} else if !dip.Dcache.Complete() {
+		inum, finalOffset = ScanName(dip, op, name)
+		if inum != common.NULLINUM {
+			dip.Dcache.Add(string(name), inum, finalOffset)
+		}
 	}
 	return inum, finalOffset
 }
 
+// AddName adds name to dip, updating dip's mtime and ctime (through
+// dip.Write).  A linear directory switches to the indexed format when
+// its first block is full.  Returns false if there is no space for
+// name: the disk or dip is full, or name's leaf is full of names with
+// name's hash (see indexAdd).
 func AddName(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name nfstypes.Filename3) bool {
-	if dip.Kind != nfstypes.NF3DIR || uint64(len(name)) >= MAXNAMELEN {
+	if dip.Kind != nfstypes.NF3DIR || NameTooLong(name) {
 		return false
 	}
+	if isIndexed(dip) {
+		return indexAdd(dip, op, inum, name)
+	}
+	if dip.Size == disk.BlockSize && !hasSpace(dip, op, uint64(len(name))) {
+		if !convertDir(dip, op) {
+			return false
+		}
+		return indexAdd(dip, op, inum, name)
+	}
 	if dip.Dcache == nil {
 		mkDcache(dip, op)
 	}
@@ -48,9 +78,15 @@ func AddName(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name nfstypes.
 	return ok
 }
 
-func RemName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
-	if dip.Kind != nfstypes.NF3DIR || uint64(len(name)) >= MAXNAMELEN {
-		return false
+// RemName removes name from dip, updating dip's mtime and ctime.  An
+// indexed directory may truncate blocks it no longer uses; RemName
+// returns whether freeing them needs the shrinker, like Resize.
+func RemName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (bool, bool) {
+	if dip.Kind != nfstypes.NF3DIR || NameTooLong(name) {
+		return false, false
+	}
+	if isIndexed(dip) {
+		return indexRem(dip, op, name)
 	}
 	if dip.Dcache == nil {
 		mkDcache(dip, op)
@@ -62,7 +98,24 @@ func RemName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
 		if !ok {
 			panic("RemName")
 		}
-		return true
+		return true, false
+	}
+	return false, false
+}
+
+// SetDotDot points dip's ".." at parent, for a directory that moved to
+// a new parent.  The caller is responsible for the link counts.
+func SetDotDot(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
+	if isIndexed(dip) {
+		return indexSetDotDot(dip, op, parent)
+	}
+	inum, off := LookupName(dip, op, "..")
+	if inum == common.NULLINUM {
+		return false
+	}
+	if !setInum(dip, op, off, parent) {
+		return false
 	}
-	return false
+	dip.Dcache.Add("..", parent, off)
+	return true
 }
@@ -1,6 +1,7 @@
 package dir
 
 import (
+	"github.com/tchajed/goose/machine/disk"
 	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/common"
@@ -10,12 +11,29 @@ import (
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
-const DIRENTSZ uint64 = 128
-const MAXNAMELEN = DIRENTSZ - 16 // uint64 for inum + uint64 for len(name)
+//
+// A directory block holds variable-length records, each with an inum,
+// the length of the record, and a name.  The records of a linear
+// directory tile its blocks: a record may be longer than its name
+// needs, and the rest is free space for a new entry.  Removing an entry
+// merges its record into the previous one, or frees it (inum 0) if it
+// is the first in the block, so entries never move.  The READDIR
+// cookie of an entry is its offset plus one, since cookie 0 means the
+// start of the directory.
+//
+// Cookies are valid while the directory's DirGen stays the same, which
+// the cookie verifier encodes.  DirGen changes when the directory
+// switches to the indexed format.
+//
+
+const DIRHDRSZ uint64 = 16    // uint64 for inum, uint32 for record length and len(name)
+const MAXNAMELEN uint64 = 255 // POSIX NAME_MAX
 
 type dirEnt struct {
-	inum common.Inum
-	name string // <= MAXNAMELEN
+	inum   common.Inum
+	name   string // <= MAXNAMELEN
+	off    uint64 // in the block
+	reclen uint64
 }
 
 func IllegalName(name nfstypes.Filename3) bool {
@@ -23,94 +41,178 @@ func IllegalName(name nfstypes.Filename3) bool {
 	return n == "." || n == ".."
 }
 
+func NameTooLong(name nfstypes.Filename3) bool {
+	return uint64(len(name)) > MAXNAMELEN
+}
+
+// entSize is the size of a record for a name of namelen bytes, which
+// keeps records 8-byte aligned
+func entSize(namelen uint64) uint64 {
+	return util.RoundUp(DIRHDRSZ+namelen, 8) * 8
+}
+
+// used is the part of de's record that de needs
+func (de *dirEnt) used() uint64 {
+	if de.inum == common.NULLINUM {
+		return 0
+	}
+	return entSize(uint64(len(de.name)))
+}
+
 func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64) {
 	if dip.Kind != nfstypes.NF3DIR {
 		return common.NULLINUM, 0
 	}
 	var inum = common.NULLINUM
 	var finalOffset uint64 = 0
-	for off := uint64(0); off < dip.Size; off += DIRENTSZ {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		if uint64(len(data)) != DIRENTSZ {
-			break
-		}
-		de := decodeDirEnt(data)
-		if de.inum == common.NULLINUM {
-			continue
-		}
-		if de.name == string(name) {
-			inum = de.inum
+	linearApply(dip, op, 0, func(n string, i common.Inum, off uint64) bool {
+		if n == string(name) {
+			inum = i
 			finalOffset = off
-			break
+			return false
 		}
-	}
+		return true
+	})
 	return inum, finalOffset
 }
 
+func readDirBlock(dip *inode.Inode, op *fstxn.FsTxn, off uint64) []byte {
+	data, _ := dip.Read(op.Atxn, off, disk.BlockSize)
+	if uint64(len(data)) != disk.BlockSize {
+		panic("readDirBlock")
+	}
+	return data
+}
+
+// findSpace returns the block offset and the entries of the first
+// block at or after the block of lastoff with space for a name of
+// namelen bytes, and the entry whose record has the space.  Returns
+// false if there is none.
+func findSpace(dip *inode.Inode, op *fstxn.FsTxn, lastoff uint64,
+	namelen uint64) (uint64, []byte, *dirEnt, bool) {
+	need := entSize(namelen)
+	var boff = lastoff - lastoff%disk.BlockSize
+	for ; boff < dip.Size; boff += disk.BlockSize {
+		data := readDirBlock(dip, op, boff)
+		for _, de := range decodeBlock(data) {
+			if de.reclen-de.used() >= need {
+				return boff, data, de, true
+			}
+		}
+	}
+	return 0, nil, nil, false
+}
+
+func hasSpace(dip *inode.Inode, op *fstxn.FsTxn, namelen uint64) bool {
+	_, _, _, ok := findSpace(dip, op, 0, namelen)
+	return ok
+}
+
+// AddNameDir adds an entry for name to the first block at or after the
+// block of lastoff with space, or to a new block at the end of dip,
+// and returns the offset of the entry.
 func AddNameDir(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum,
 	name nfstypes.Filename3, lastoff uint64) (uint64, bool) {
-	var finalOff uint64
-
-	for off := uint64(lastoff); off < dip.Size; off += DIRENTSZ {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		if de.inum == common.NULLINUM {
-			finalOff = off
-			break
-		}
+	boff, data, de, ok := findSpace(dip, op, lastoff, uint64(len(name)))
+	if !ok {
+		boff = dip.Size
+		data = make([]byte, disk.BlockSize)
+		de = &dirEnt{inum: common.NULLINUM, name: "", off: 0, reclen: disk.BlockSize}
 	}
-	if finalOff == 0 {
-		finalOff = dip.Size
+	used := de.used()
+	newde := &dirEnt{inum: inum, name: string(name), off: de.off + used,
+		reclen: de.reclen - used}
+	if used > 0 {
+		de.reclen = used
+		putDirEnt(data, de)
 	}
-	de := &dirEnt{inum: inum, name: string(name)}
-	ent := encodeDirEnt(de)
-	util.DPrintf(5, "AddNameDir # %v: %v %v %v off %d\n", dip.Inum, name, de, ent, finalOff)
-	n, _ := dip.Write(op.Atxn, finalOff, DIRENTSZ, ent)
-	return finalOff, n == DIRENTSZ
+	putDirEnt(data, newde)
+	util.DPrintf(5, "AddNameDir # %v: %v %v off %d\n", dip.Inum, name, inum, boff+newde.off)
+	n, _ := dip.Write(op.Atxn, boff, disk.BlockSize, data)
+	return boff + newde.off, n == disk.BlockSize
 }
 
+// RemNameDir removes name, merging its record into the previous one
+// in its block.
 func RemNameDir(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (uint64, bool) {
 	inum, off := LookupName(dip, op, name)
 	if inum == common.NULLINUM {
 		return 0, false
 	}
 	util.DPrintf(5, "RemNameDir # %v: %v %v off %d\n", dip.Inum, name, inum, off)
-	de := &dirEnt{inum: common.NULLINUM, name: ""}
-	ent := encodeDirEnt(de)
-	n, _ := dip.Write(op.Atxn, off, DIRENTSZ, ent)
-	return off, n == DIRENTSZ
+	boff := off - off%disk.BlockSize
+	data := readDirBlock(dip, op, boff)
+	var prev *dirEnt
+	for _, de := range decodeBlock(data) {
+		if boff+de.off == off {
+			if prev == nil {
+				de.inum = common.NULLINUM
+				de.name = ""
+				putDirEnt(data, de)
+			} else {
+				prev.reclen = prev.reclen + de.reclen
+				putDirEnt(data, prev)
+			}
+			n, _ := dip.Write(op.Atxn, boff, disk.BlockSize, data)
+			return off, n == disk.BlockSize
+		}
+		prev = de
+	}
+	return 0, false
+}
+
+// setInum points the entry at off to inum
+func setInum(dip *inode.Inode, op *fstxn.FsTxn, off uint64, inum common.Inum) bool {
+	boff := off - off%disk.BlockSize
+	data := readDirBlock(dip, op, boff)
+	for _, de := range decodeBlock(data) {
+		if boff+de.off == off {
+			de.inum = inum
+			putDirEnt(data, de)
+			n, _ := dip.Write(op.Atxn, boff, disk.BlockSize, data)
+			return n == disk.BlockSize
+		}
+	}
+	return false
 }
 
 func IsDirEmpty(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	if isIndexed(dip) {
+		return indexEmpty(dip, op)
+	}
 	var empty bool = true
-
-	// check all entries after . and ..
-	for off := uint64(2 * DIRENTSZ); off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
+	linearApply(dip, op, 0, func(name string, inum common.Inum, off uint64) bool {
+		if name != "." && name != ".." {
+			empty = false
+			return false
 		}
-		empty = false
-		break
-	}
+		return true
+	})
 	util.DPrintf(10, "IsDirEmpty: %v -> %v\n", dip, empty)
 	return empty
 }
 
+// InitDir adds "." and ".." to a new directory, and counts "." as a
+// link to dip.  The caller is responsible for the link ".." adds to
+// parent.
 func InitDir(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
 	if !AddName(dip, op, dip.Inum, ".") {
 		return false
 	}
-	return AddName(dip, op, parent, "..")
+	if !AddName(dip, op, parent, "..") {
+		return false
+	}
+	return dip.IncLink(op.Atxn)
 }
 
 func MkRootDir(dip *inode.Inode, op *fstxn.FsTxn) bool {
 	if !AddName(dip, op, dip.Inum, ".") {
 		return false
 	}
-	return AddName(dip, op, dip.Inum, "..")
+	if !AddName(dip, op, dip.Inum, "..") {
+		return false
+	}
+	return dip.IncLink(op.Atxn)
 }
 
 const fattr3XDRsize uint64 = 4 + 4 + 4 + // type, mode, nlink
@@ -128,106 +230,129 @@ const entryplus3Baggage uint64 = 8 + // fileid
 	16 + // name_handle
 	8 // pointer
 
-// XXX inode locking order violated
+// linearApply calls f on the entries of a linear directory at or after
+// offset begin, until f returns false.  Returns true if f saw the last
+// entry.
+func linearApply(dip *inode.Inode, op *fstxn.FsTxn, begin uint64,
+	f func(string, common.Inum, uint64) bool) bool {
+	for boff := begin - begin%disk.BlockSize; boff < dip.Size; boff += disk.BlockSize {
+		for _, de := range decodeBlock(readDirBlock(dip, op, boff)) {
+			off := boff + de.off
+			util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
+			if de.inum == common.NULLINUM || off < begin {
+				continue
+			}
+			if !f(de.name, de.inum, off) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// applyEnts calls f with the name, inum, and cookie of the entries
+// after cookie start, until f returns false.  Returns true if f saw the
+// last entry.
+func applyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
+	f func(string, common.Inum, uint64) bool) bool {
+	if isIndexed(dip) {
+		return indexApply(dip, op, start, f)
+	}
+	return linearApply(dip, op, start, func(name string, inum common.Inum, off uint64) bool {
+		return f(name, inum, off+1)
+	})
+}
+
+// CookieVerf returns the verifier for the READDIR cookies of dip
+func CookieVerf(dip *inode.Inode) nfstypes.Cookieverf3 {
+	var verf nfstypes.Cookieverf3
+	enc := marshal.NewEnc(8)
+	enc.PutInt(dip.DirGen)
+	copy(verf[:], enc.Finish())
+	return verf
+}
+
+// Apply calls f with each entry after cookie start and its inode,
+// locked, until the reply budget runs out.  Locking a child with a
+// lower inum than dip would violate the lock order, so f gets a nil
+// inode for it instead; the attributes and handle of an entryplus3 are
+// optional, and the client looks up the name for them.
 func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 	dircount uint64, maxcount uint64,
 	f func(*inode.Inode, string, common.Inum, uint64)) bool {
-	var eof bool = true
-	var ip *inode.Inode
-	var begin = uint64(start)
-	if begin != 0 {
-		begin += DIRENTSZ
-	}
 	// TODO: arbitrary estimate of constant XDR overhead
 	var n uint64 = uint64(64)
 	var dirbytes uint64 = uint64(0)
-	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
-		}
-
+	return applyEnts(dip, op, start, func(name string, inum common.Inum, off uint64) bool {
+		var ip *inode.Inode
 		// Lock inode, if this transaction doesn't own it already
 		var own bool = false
-		if op.OwnInum(de.inum) {
+		if op.OwnInum(inum) {
 			own = true
-			ip = op.GetInodeUnlocked(de.inum)
-		} else {
-			ip = op.GetInodeInum(de.inum)
-
+			ip = op.GetInodeUnlocked(inum)
+		} else if inum > dip.Inum {
+			ip = op.GetInodeInum(inum)
 		}
 
-		f(ip, de.name, de.inum, off)
+		f(ip, name, inum, off)
 
 		// Release inode early, if this trans didn't own it before.
-		if !own {
+		if ip != nil && !own {
 			op.ReleaseInode(ip)
 		}
 
-		off = off + DIRENTSZ
 		// TODO: unclear what dircount is supposed to included so we pad it with
 		// 8 bytes per entry
-		dirbytes += uint64(8 + len(de.name))
-		n += entryplus3Baggage + uint64(len(de.name))
-		if dirbytes >= dircount || n >= maxcount {
-			eof = false
-			break
-		}
-	}
-	return eof
+		dirbytes += uint64(8 + len(name))
+		n += entryplus3Baggage + uint64(len(name))
+		return dirbytes < dircount && n < maxcount
+	})
 }
 
 func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
 	f func(string, common.Inum, uint64)) bool {
-	var eof bool = true
-	var begin = uint64(start)
-	if begin != 0 {
-		begin += DIRENTSZ
-	}
 	// TODO: this is supposed to track the size of the XDR-encoded reply in
 	// bytes, and we somewhat arbitrarily use 64 as the constant overhead
 	var n uint64 = uint64(64)
-	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
-		}
-		f(de.name, de.inum, off)
-
-		off = off + DIRENTSZ
+	return applyEnts(dip, op, start, func(name string, inum common.Inum, off uint64) bool {
+		f(name, inum, off)
 		// TODO: estimate of XDR overhead, 16-byte file id, name, cookie, and
 		// pointer for linked list
-		n += uint64(16 + len(de.name) + 8 + 8)
-		if n >= count {
-			eof = false
-			break
-		}
-	}
-	return eof
+		n += uint64(16 + len(name) + 8 + 8)
+		return n < count
+	})
 }
 
-// Caller must ensure de.Name fits
-func encodeDirEnt(de *dirEnt) []byte {
-	enc := marshal.NewEnc(DIRENTSZ)
+// putDirEnt writes de's record header and name into the block data
+func putDirEnt(data []byte, de *dirEnt) {
+	enc := marshal.NewEnc(DIRHDRSZ + uint64(len(de.name)))
 	enc.PutInt(uint64(de.inum))
-	enc.PutInt(uint64(len(de.name)))
+	enc.PutInt32(uint32(de.reclen))
+	enc.PutInt32(uint32(len(de.name)))
 	enc.PutBytes([]byte(de.name))
-	return enc.Finish()
+	copy(data[de.off:], enc.Finish())
 }
 
-func decodeDirEnt(d []byte) *dirEnt {
-	dec := marshal.NewDec(d)
-	inum := dec.GetInt()
-	l := dec.GetInt()
-	name := string(dec.GetBytes(l))
-	return &dirEnt{
-		inum: common.Inum(inum),
-		name: name,
+// decodeBlock returns the records in data, including free ones
+func decodeBlock(data []byte) []*dirEnt {
+	var ents = make([]*dirEnt, 0)
+	var off uint64 = 0
+	for off+DIRHDRSZ <= uint64(len(data)) {
+		dec := marshal.NewDec(data[off:])
+		inum := common.Inum(dec.GetInt())
+		reclen := uint64(dec.GetInt32())
+		l := uint64(dec.GetInt32())
+		if reclen < DIRHDRSZ || off+reclen > uint64(len(data)) ||
+			DIRHDRSZ+l > reclen {
+			panic("decodeBlock")
+		}
+		ents = append(ents, &dirEnt{
+			inum:   inum,
+			name:   string(dec.GetBytes(l)),
+			off:    off,
+			reclen: reclen,
+		})
+		off = off + reclen
 	}
+	return ents
 }
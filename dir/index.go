@@ -0,0 +1,739 @@
+package dir
+
+import (
+	"sort"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Indexed directories.  A directory starts out linear, an array of
+// dirEnts, and switches to the indexed format when it outgrows its
+// first block.  An indexed directory is a B+tree keyed by the hash of
+// the name, stored in the directory's blocks:
+//
+//   block 0: header (root, height, # entries, ".", "..", and the
+//            first free node)
+//   leaf:    kind, next leaf, lowest key, and unsorted dirEnt records,
+//            packed
+//   inner:   kind, # children, and sorted (key, child) pairs; child i
+//            holds the keys in [key i, key i+1)
+//   free:    kind, previous and next free node
+//
+// Lookup, insert, and delete read one block per level.  Entries with
+// the same hash are never split across leaves, so a name is in exactly
+// one leaf.  The hash of an entry is its READDIR cookie; "." and ".."
+// have cookies DOTKEY and DOTDOTKEY, below all hashes.  A directory
+// can therefore hold at most a leaf of names with the same hash (at
+// least 14 names, for 255-byte ones), since READDIR can't resume in
+// the middle of entries with one cookie anyway; adding another fails
+// as if the directory were full.
+//
+// Delete merges a node that is less than a quarter full into a sibling
+// with the same parent, if together they fill at most half a node, and
+// shortens the tree when the root has a single child.  Merged-away
+// nodes go on a free list for reuse.  The node in the last block of the
+// directory moves to a free node, which it finds its parent (and, for a
+// leaf, the previous leaf) with its lowest key, and the last block is
+// truncated.  Entries keep their hash when they move, so cookies stay
+// valid.
+//
+
+const (
+	DOTKEY    uint64 = 1
+	DOTDOTKEY uint64 = 2
+	MINKEY    uint64 = 3 // smallest hash of a name
+
+	nodeLeaf  uint64 = 1
+	nodeInner uint64 = 2
+	nodeFree  uint64 = 3
+
+	LEAFSZ    uint64 = disk.BlockSize - 24        // bytes for the dirEnts of a leaf
+	NINNERENT uint64 = (disk.BlockSize - 16) / 16 // # children per inner node
+
+	MAXTRUNC uint64 = 8 // # blocks truncated per delete
+)
+
+type dirHdr struct {
+	root   uint64 // block # of the root
+	height uint64 // # levels of inner nodes
+	nent   uint64 // # entries, excluding "." and ".."
+	dot    common.Inum
+	dotdot common.Inum
+	free   uint64 // block # of the first free node, 0 if none
+}
+
+type leaf struct {
+	next uint64    // block # of the leaf with the next keys, 0 if none
+	low  uint64    // lowest key of the leaf, its key in the parent
+	ents []*dirEnt // in use
+}
+
+type inner struct {
+	keys []uint64
+	kids []uint64
+}
+
+func isIndexed(dip *inode.Inode) bool {
+	return dip.Flags&inode.INDEXED != 0
+}
+
+// hashName is FNV-1a, moved above the keys of "." and "..".  Names
+// with the same hash must share a leaf, so a directory holds at most a
+// leaf of them; indexAdd fails to add one more.
+func hashName(name string) uint64 {
+	var h uint64 = 14695981039346656037
+	for i := 0; i < len(name); i++ {
+		h = h ^ uint64(name[i])
+		h = h * 1099511628211
+	}
+	if h < MINKEY {
+		return MINKEY
+	}
+	return h
+}
+
+func readNode(dip *inode.Inode, op *fstxn.FsTxn, bn uint64) []byte {
+	data, _ := dip.Read(op.Atxn, bn*disk.BlockSize, disk.BlockSize)
+	if uint64(len(data)) != disk.BlockSize {
+		panic("readNode")
+	}
+	return data
+}
+
+func writeNode(dip *inode.Inode, op *fstxn.FsTxn, bn uint64, data []byte) bool {
+	n, _ := dip.Write(op.Atxn, bn*disk.BlockSize, disk.BlockSize, data)
+	return n == disk.BlockSize
+}
+
+// newNode returns the block # for a new node at the end of dip
+func newNode(dip *inode.Inode) uint64 {
+	return util.RoundUp(dip.Size, disk.BlockSize)
+}
+
+func nodeKind(dip *inode.Inode, op *fstxn.FsTxn, bn uint64) uint64 {
+	return marshal.NewDec(readNode(dip, op, bn)).GetInt()
+}
+
+// readFree returns the previous and next node on the free list
+func readFree(dip *inode.Inode, op *fstxn.FsTxn, bn uint64) (uint64, uint64) {
+	dec := marshal.NewDec(readNode(dip, op, bn))
+	if dec.GetInt() != nodeFree {
+		panic("readFree")
+	}
+	prev := dec.GetInt()
+	next := dec.GetInt()
+	return prev, next
+}
+
+func writeFree(dip *inode.Inode, op *fstxn.FsTxn, bn uint64, prev uint64, next uint64) bool {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(nodeFree)
+	enc.PutInt(prev)
+	enc.PutInt(next)
+	return writeNode(dip, op, bn, enc.Finish())
+}
+
+// allocNode returns the block # for a new node, reusing a free node if
+// there is one.  The caller writes hdr.
+func allocNode(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) (uint64, bool) {
+	if hdr.free == 0 {
+		return newNode(dip), true
+	}
+	bn := hdr.free
+	if !unlinkFree(dip, op, hdr, bn) {
+		return 0, false
+	}
+	return bn, true
+}
+
+// freeNode puts bn at the front of the free list.  The caller writes
+// hdr.
+func freeNode(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, bn uint64) bool {
+	if hdr.free != 0 {
+		_, next := readFree(dip, op, hdr.free)
+		if !writeFree(dip, op, hdr.free, bn, next) {
+			return false
+		}
+	}
+	if !writeFree(dip, op, bn, 0, hdr.free) {
+		return false
+	}
+	hdr.free = bn
+	return true
+}
+
+// unlinkFree removes bn from the free list
+func unlinkFree(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, bn uint64) bool {
+	prev, next := readFree(dip, op, bn)
+	if prev == 0 {
+		hdr.free = next
+	} else {
+		pprev, _ := readFree(dip, op, prev)
+		if !writeFree(dip, op, prev, pprev, next) {
+			return false
+		}
+	}
+	if next != 0 {
+		_, nnext := readFree(dip, op, next)
+		if !writeFree(dip, op, next, prev, nnext) {
+			return false
+		}
+	}
+	return true
+}
+
+// setChild points the parent of the node at bn, whose keys include
+// key, to nbn.  Fails if the path to key doesn't lead to bn, which only
+// a corrupt index does.
+func setChild(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, key uint64,
+	bn uint64, nbn uint64) bool {
+	if hdr.root == bn {
+		hdr.root = nbn
+		return true
+	}
+	path, _ := descend(dip, op, hdr, key)
+	for _, pbn := range path {
+		in := readInner(dip, op, pbn)
+		c := in.child(key)
+		if in.kids[c] == bn {
+			in.kids[c] = nbn
+			return writeInner(dip, op, pbn, in)
+		}
+	}
+	util.DPrintf(0, "setChild # %v: no parent for %d\n", dip.Inum, bn)
+	return false
+}
+
+// moveNode moves the leaf or inner node at bn to nbn
+func moveNode(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, bn uint64, nbn uint64) bool {
+	if nodeKind(dip, op, bn) == nodeInner {
+		in := readInner(dip, op, bn)
+		return setChild(dip, op, hdr, in.keys[0], bn, nbn) &&
+			writeInner(dip, op, nbn, in)
+	}
+	l := readLeaf(dip, op, bn)
+	if !setChild(dip, op, hdr, l.low, bn, nbn) {
+		return false
+	}
+	if l.low != 0 {
+		_, pbn := descend(dip, op, hdr, l.low-1)
+		prev := readLeaf(dip, op, pbn)
+		prev.next = nbn
+		if !writeLeaf(dip, op, pbn, prev) {
+			return false
+		}
+	}
+	return writeLeaf(dip, op, nbn, l)
+}
+
+// truncFree truncates up to MAXTRUNC blocks at the end of dip while
+// there are free nodes, moving nodes in those blocks to free ones.
+// Does nothing if freeing the blocks might not fit in op.  Returns
+// whether dip needs the shrinker to free the blocks, like Resize.  The
+// caller writes hdr.
+func truncFree(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) (bool, bool) {
+	var nblk = util.RoundUp(dip.Size, disk.BlockSize)
+	size := nblk
+	var n = MAXTRUNC
+	if n > nblk-2 {
+		n = nblk - 2
+	}
+	if !dip.ShrinkFits(op.Atxn, (nblk-n)*disk.BlockSize, n*(hdr.height+4)) {
+		return true, false
+	}
+	for nblk > size-n && hdr.free != 0 {
+		last := nblk - 1
+		if nodeKind(dip, op, last) == nodeFree {
+			if !unlinkFree(dip, op, hdr, last) {
+				return false, false
+			}
+		} else {
+			nbn, ok := allocNode(dip, op, hdr)
+			if !ok || !moveNode(dip, op, hdr, last, nbn) {
+				return false, false
+			}
+		}
+		nblk = nblk - 1
+	}
+	var shrink = false
+	if nblk < size {
+		util.DPrintf(1, "truncFree # %v: %d blocks\n", dip.Inum, size-nblk)
+		shrink = dip.Resize(op.Atxn, nblk*disk.BlockSize)
+	}
+	return true, shrink
+}
+
+func readHdr(dip *inode.Inode, op *fstxn.FsTxn) *dirHdr {
+	dec := marshal.NewDec(readNode(dip, op, 0))
+	return &dirHdr{
+		root:   dec.GetInt(),
+		height: dec.GetInt(),
+		nent:   dec.GetInt(),
+		dot:    common.Inum(dec.GetInt()),
+		dotdot: common.Inum(dec.GetInt()),
+		free:   dec.GetInt(),
+	}
+}
+
+func writeHdr(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) bool {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(hdr.root)
+	enc.PutInt(hdr.height)
+	enc.PutInt(hdr.nent)
+	enc.PutInt(uint64(hdr.dot))
+	enc.PutInt(uint64(hdr.dotdot))
+	enc.PutInt(hdr.free)
+	return writeNode(dip, op, 0, enc.Finish())
+}
+
+func readLeaf(dip *inode.Inode, op *fstxn.FsTxn, bn uint64) *leaf {
+	dec := marshal.NewDec(readNode(dip, op, bn))
+	if dec.GetInt() != nodeLeaf {
+		panic("readLeaf")
+	}
+	next := dec.GetInt()
+	low := dec.GetInt()
+	l := &leaf{next: next, low: low, ents: make([]*dirEnt, 0)}
+	for _, de := range decodeBlock(dec.GetBytes(LEAFSZ)) {
+		if de.inum != common.NULLINUM {
+			l.ents = append(l.ents, de)
+		}
+	}
+	return l
+}
+
+// entsSize is the space ents take in a leaf
+func entsSize(ents []*dirEnt) uint64 {
+	var sz uint64 = 0
+	for _, de := range ents {
+		sz = sz + entSize(uint64(len(de.name)))
+	}
+	return sz
+}
+
+// writeLeaf packs the entries of l; the last record, or a free one if
+// there are none, gets the rest of the leaf.
+func writeLeaf(dip *inode.Inode, op *fstxn.FsTxn, bn uint64, l *leaf) bool {
+	if entsSize(l.ents) > LEAFSZ {
+		panic("writeLeaf")
+	}
+	enc := marshal.NewEnc(24)
+	enc.PutInt(nodeLeaf)
+	enc.PutInt(l.next)
+	enc.PutInt(l.low)
+	data := make([]byte, disk.BlockSize)
+	copy(data, enc.Finish())
+	recs := data[24:]
+	var off uint64 = 0
+	for i, e := range l.ents {
+		de := &dirEnt{inum: e.inum, name: e.name, off: off,
+			reclen: entSize(uint64(len(e.name)))}
+		if i == len(l.ents)-1 {
+			de.reclen = LEAFSZ - off
+		}
+		putDirEnt(recs, de)
+		off = off + de.reclen
+	}
+	if len(l.ents) == 0 {
+		putDirEnt(recs, &dirEnt{inum: common.NULLINUM, name: "", off: 0, reclen: LEAFSZ})
+	}
+	return writeNode(dip, op, bn, data)
+}
+
+func readInner(dip *inode.Inode, op *fstxn.FsTxn, bn uint64) *inner {
+	dec := marshal.NewDec(readNode(dip, op, bn))
+	if dec.GetInt() != nodeInner {
+		panic("readInner")
+	}
+	n := dec.GetInt()
+	in := &inner{keys: make([]uint64, n), kids: make([]uint64, n)}
+	for i := uint64(0); i < n; i++ {
+		in.keys[i] = dec.GetInt()
+		in.kids[i] = dec.GetInt()
+	}
+	return in
+}
+
+func writeInner(dip *inode.Inode, op *fstxn.FsTxn, bn uint64, in *inner) bool {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(nodeInner)
+	enc.PutInt(uint64(len(in.keys)))
+	for i := range in.keys {
+		enc.PutInt(in.keys[i])
+		enc.PutInt(in.kids[i])
+	}
+	return writeNode(dip, op, bn, enc.Finish())
+}
+
+// child returns the index of the child of in that holds key
+func (in *inner) child(key uint64) int {
+	var c = 0
+	for i, k := range in.keys {
+		if k <= key {
+			c = i
+		}
+	}
+	return c
+}
+
+// descend returns the leaf that holds key, and the inner nodes on the
+// way to it.
+func descend(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, key uint64) ([]uint64, uint64) {
+	var path = make([]uint64, 0)
+	var bn = hdr.root
+	for i := uint64(0); i < hdr.height; i++ {
+		path = append(path, bn)
+		in := readInner(dip, op, bn)
+		bn = in.kids[in.child(key)]
+	}
+	return path, bn
+}
+
+func indexLookup(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) common.Inum {
+	hdr := readHdr(dip, op)
+	if name == "." {
+		return hdr.dot
+	}
+	if name == ".." {
+		return hdr.dotdot
+	}
+	_, bn := descend(dip, op, hdr, hashName(string(name)))
+	l := readLeaf(dip, op, bn)
+	for _, de := range l.ents {
+		if de.name == string(name) {
+			return de.inum
+		}
+	}
+	return common.NULLINUM
+}
+
+// sortEnts sorts the entries by key
+func sortEnts(ents []*dirEnt) []*dirEnt {
+	var sorted = make([]*dirEnt, len(ents))
+	copy(sorted, ents)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return hashName(sorted[i].name) < hashName(sorted[j].name)
+	})
+	return sorted
+}
+
+// splitPoint returns the index that starts a new key in sorted,
+// closest to splitting the bytes of the entries in half, such that
+// both halves fit in a leaf.  Returns 0 if there is none.
+func splitPoint(sorted []*dirEnt) int {
+	total := entsSize(sorted)
+	var best = 0
+	var bestDist = total
+	var sz uint64 = 0
+	for i := 1; i < len(sorted); i++ {
+		sz = sz + entSize(uint64(len(sorted[i-1].name)))
+		if hashName(sorted[i-1].name) == hashName(sorted[i].name) ||
+			sz > LEAFSZ || total-sz > LEAFSZ {
+			continue
+		}
+		var dist = total/2 - sz
+		if sz > total/2 {
+			dist = sz - total/2
+		}
+		if dist < bestDist {
+			best = i
+			bestDist = dist
+		}
+	}
+	return best
+}
+
+// insertInner adds child with key to the inner nodes on path, from
+// the bottom up, splitting full nodes and growing a new root if the
+// root splits.
+func insertInner(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, path []uint64,
+	key uint64, child uint64) bool {
+	var k = key
+	var c = child
+	for i := len(path) - 1; i >= 0; i-- {
+		in := readInner(dip, op, path[i])
+		pos := in.child(k) + 1
+		in.keys = append(in.keys[:pos], append([]uint64{k}, in.keys[pos:]...)...)
+		in.kids = append(in.kids[:pos], append([]uint64{c}, in.kids[pos:]...)...)
+		if uint64(len(in.keys)) <= NINNERENT {
+			return writeInner(dip, op, path[i], in)
+		}
+		mid := len(in.keys) / 2
+		right := &inner{keys: in.keys[mid:], kids: in.kids[mid:]}
+		in.keys = in.keys[:mid]
+		in.kids = in.kids[:mid]
+		bn, ok := allocNode(dip, op, hdr)
+		if !ok || !writeInner(dip, op, bn, right) || !writeInner(dip, op, path[i], in) {
+			return false
+		}
+		k = right.keys[0]
+		c = bn
+	}
+	root := &inner{keys: []uint64{0, k}, kids: []uint64{hdr.root, c}}
+	bn, ok := allocNode(dip, op, hdr)
+	if !ok || !writeInner(dip, op, bn, root) {
+		return false
+	}
+	hdr.root = bn
+	hdr.height = hdr.height + 1
+	return true
+}
+
+func indexAdd(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name nfstypes.Filename3) bool {
+	hdr := readHdr(dip, op)
+	de := &dirEnt{inum: inum, name: string(name)}
+	path, bn := descend(dip, op, hdr, hashName(de.name))
+	l := readLeaf(dip, op, bn)
+	if entsSize(l.ents)+entSize(uint64(len(de.name))) <= LEAFSZ {
+		l.ents = append(l.ents, de)
+		if !writeLeaf(dip, op, bn, l) {
+			return false
+		}
+	} else {
+		sorted := sortEnts(append(l.ents, de))
+		mid := splitPoint(sorted)
+		if mid == 0 {
+			// a leaf full of names with one hash, which can't split
+			util.DPrintf(0, "indexAdd: leaf %d of # %v is full of names with one hash\n", bn, dip.Inum)
+			return false
+		}
+		rbn, ok := allocNode(dip, op, hdr)
+		if !ok {
+			return false
+		}
+		right := &leaf{next: l.next, low: hashName(sorted[mid].name), ents: sorted[mid:]}
+		left := &leaf{next: rbn, low: l.low, ents: sorted[:mid]}
+		if !writeLeaf(dip, op, rbn, right) || !writeLeaf(dip, op, bn, left) {
+			return false
+		}
+		if !insertInner(dip, op, hdr, path, hashName(sorted[mid].name), rbn) {
+			return false
+		}
+	}
+	hdr.nent = hdr.nent + 1
+	return writeHdr(dip, op, hdr)
+}
+
+// siblings returns the index of child bn in in, and the indices of the
+// two adjacent children to merge it with.
+func (in *inner) siblings(bn uint64) (int, int, int) {
+	var i = 0
+	for j, kid := range in.kids {
+		if kid == bn {
+			i = j
+		}
+	}
+	if i == 0 {
+		return i, 0, 1
+	}
+	return i, i - 1, i
+}
+
+// shortenTree removes roots with a single child
+func shortenTree(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) bool {
+	for hdr.height > 0 {
+		root := readInner(dip, op, hdr.root)
+		if len(root.kids) > 1 {
+			break
+		}
+		if !freeNode(dip, op, hdr, hdr.root) {
+			return false
+		}
+		hdr.root = root.kids[0]
+		hdr.height = hdr.height - 1
+	}
+	return true
+}
+
+// removeChild removes child ri of the inner node path[d], which the
+// caller merged into child ri-1, and merges path[d] with a sibling
+// if it is underfull.
+func removeChild(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, path []uint64,
+	d int, ri int) bool {
+	bn := path[d]
+	in := readInner(dip, op, bn)
+	if !freeNode(dip, op, hdr, in.kids[ri]) {
+		return false
+	}
+	in.keys = append(in.keys[:ri], in.keys[ri+1:]...)
+	in.kids = append(in.kids[:ri], in.kids[ri+1:]...)
+	if d == 0 {
+		if len(in.kids) > 1 {
+			return writeInner(dip, op, bn, in)
+		}
+		hdr.root = in.kids[0]
+		hdr.height = hdr.height - 1
+		if !freeNode(dip, op, hdr, bn) {
+			return false
+		}
+		return shortenTree(dip, op, hdr)
+	}
+	if !writeInner(dip, op, bn, in) {
+		return false
+	}
+	if uint64(len(in.kids)) >= NINNERENT/4 {
+		return true
+	}
+	parent := readInner(dip, op, path[d-1])
+	_, li, pri := parent.siblings(bn)
+	if pri >= len(parent.kids) {
+		return true
+	}
+	left := readInner(dip, op, parent.kids[li])
+	right := readInner(dip, op, parent.kids[pri])
+	if uint64(len(left.kids)+len(right.kids)) > NINNERENT/2 {
+		return true
+	}
+	// the first key of right may be stale; its key in parent isn't
+	right.keys[0] = parent.keys[pri]
+	left.keys = append(left.keys, right.keys...)
+	left.kids = append(left.kids, right.kids...)
+	if !writeInner(dip, op, parent.kids[li], left) {
+		return false
+	}
+	return removeChild(dip, op, hdr, path, d-1, pri)
+}
+
+// mergeLeaf merges leaf bn with a sibling if it is underfull
+func mergeLeaf(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, path []uint64,
+	bn uint64) bool {
+	if len(path) == 0 {
+		return true
+	}
+	parent := readInner(dip, op, path[len(path)-1])
+	_, li, ri := parent.siblings(bn)
+	if ri >= len(parent.kids) {
+		return true
+	}
+	left := readLeaf(dip, op, parent.kids[li])
+	right := readLeaf(dip, op, parent.kids[ri])
+	if entsSize(left.ents)+entsSize(right.ents) > LEAFSZ/2 {
+		return true
+	}
+	util.DPrintf(5, "mergeLeaf # %v: %d into %d\n", dip.Inum, parent.kids[ri], parent.kids[li])
+	left.ents = append(left.ents, right.ents...)
+	left.next = right.next
+	if !writeLeaf(dip, op, parent.kids[li], left) {
+		return false
+	}
+	return removeChild(dip, op, hdr, path, len(path)-1, ri)
+}
+
+// indexRem removes name, and returns whether dip needs the shrinker
+func indexRem(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (bool, bool) {
+	hdr := readHdr(dip, op)
+	path, bn := descend(dip, op, hdr, hashName(string(name)))
+	l := readLeaf(dip, op, bn)
+	for i, de := range l.ents {
+		if de.name == string(name) {
+			l.ents = append(l.ents[:i], l.ents[i+1:]...)
+			hdr.nent = hdr.nent - 1
+			if !writeLeaf(dip, op, bn, l) {
+				return false, false
+			}
+			if entsSize(l.ents) < LEAFSZ/4 && !mergeLeaf(dip, op, hdr, path, bn) {
+				return false, false
+			}
+			var shrink = false
+			if hdr.free != 0 {
+				ok, s := truncFree(dip, op, hdr)
+				if !ok {
+					return false, false
+				}
+				shrink = s
+			}
+			return writeHdr(dip, op, hdr), shrink
+		}
+	}
+	return false, false
+}
+
+func indexSetDotDot(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
+	hdr := readHdr(dip, op)
+	hdr.dotdot = parent
+	return writeHdr(dip, op, hdr)
+}
+
+func indexEmpty(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	return readHdr(dip, op).nent == 0
+}
+
+// indexApply calls f on the entries with a key larger than start, in
+// key order, until f returns false.  It doesn't stop in the middle of
+// entries with the same key, because READDIR couldn't resume there.
+// Returns true if f saw the last entry.
+func indexApply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
+	f func(string, common.Inum, uint64) bool) bool {
+	hdr := readHdr(dip, op)
+	if start < DOTKEY && !f(".", hdr.dot, DOTKEY) {
+		return false
+	}
+	if start < DOTDOTKEY && !f("..", hdr.dotdot, DOTDOTKEY) {
+		return false
+	}
+	if start == ^uint64(0) {
+		return true
+	}
+	_, bn := descend(dip, op, hdr, start+1)
+	var more = true
+	for bn != 0 {
+		l := readLeaf(dip, op, bn)
+		sorted := sortEnts(l.ents)
+		for i, de := range sorted {
+			key := hashName(de.name)
+			if key <= start {
+				continue
+			}
+			if !more && key != hashName(sorted[i-1].name) {
+				return false
+			}
+			if !f(de.name, de.inum, key) {
+				more = false
+			}
+		}
+		if !more {
+			return false
+		}
+		bn = l.next
+	}
+	return true
+}
+
+// convertDir switches a linear directory to the indexed format, with
+// the entries of the linear directory in a single leaf.  The cookies
+// of the entries change, so it bumps DirGen.
+func convertDir(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	hdr := &dirHdr{root: 1, height: 0, nent: 0, free: 0}
+	l := &leaf{next: 0, low: 0, ents: make([]*dirEnt, 0)}
+	linearApply(dip, op, 0, func(name string, inum common.Inum, off uint64) bool {
+		if name == "." {
+			hdr.dot = inum
+		} else if name == ".." {
+			hdr.dotdot = inum
+		} else {
+			l.ents = append(l.ents, &dirEnt{inum: inum, name: name})
+		}
+		return true
+	})
+	if entsSize(l.ents) > LEAFSZ {
+		panic("convertDir")
+	}
+	hdr.nent = uint64(len(l.ents))
+	util.DPrintf(1, "convertDir # %v: %d entries\n", dip.Inum, hdr.nent)
+	if !writeLeaf(dip, op, 1, l) || !writeHdr(dip, op, hdr) {
+		return false
+	}
+	dip.Flags = dip.Flags | inode.INDEXED
+	dip.DirGen = dip.DirGen + 1
+	dip.WriteInode(op.Atxn)
+	dip.Dcache = nil
+	return true
+}
@@ -12,6 +12,14 @@ type Fh struct {
 	Gen uint64
 }
 
+// FHSZ is the size of the handles that the server hands out
+const FHSZ uint64 = 16
+
+// Valid reports whether fh3 has the shape of the server's handles
+func Valid(fh3 nfstypes.Nfs_fh3) bool {
+	return uint64(len(fh3.Data)) == FHSZ
+}
+
 func MakeFh(fh3 nfstypes.Nfs_fh3) Fh {
 	dec := marshal.NewDec(fh3.Data)
 	i := dec.GetInt()
@@ -20,7 +28,7 @@ func MakeFh(fh3 nfstypes.Nfs_fh3) Fh {
 }
 
 func (fh Fh) MakeFh3() nfstypes.Nfs_fh3 {
-	enc := marshal.NewEnc(16)
+	enc := marshal.NewEnc(FHSZ)
 	enc.PutInt(uint64(fh.Ino))
 	enc.PutInt(uint64(fh.Gen))
 	fh3 := nfstypes.Nfs_fh3{Data: enc.Finish()}
@@ -28,7 +36,7 @@ func (fh Fh) MakeFh3() nfstypes.Nfs_fh3 {
 }
 
 func MkRootFh3() nfstypes.Nfs_fh3 {
-	enc := marshal.NewEnc(16)
+	enc := marshal.NewEnc(FHSZ)
 	enc.PutInt(uint64(common.ROOTINUM))
 	enc.PutInt(uint64(1))
 	return nfstypes.Nfs_fh3{Data: enc.Finish()}
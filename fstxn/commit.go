@@ -1,5 +1,9 @@
 package fstxn
 
+import (
+	"github.com/mit-pdos/go-journal/common"
+)
+
 // putInodes may free an inode so must be done before commit
 func (op *FsTxn) preCommit() {
 	op.Atxn.PreCommit()
@@ -10,9 +14,16 @@ func (op *FsTxn) postCommit() {
 	op.Atxn.PostCommit()
 }
 
+// A synchronous commit of a transaction that writes flushes the log,
+// which makes the unstable writes before it durable.
 func (op *FsTxn) commitWait(wait bool) bool {
 	op.preCommit()
+	flush := wait && op.Atxn.Op.NDirty() > 0
+	seq := op.Fs.Pending.last()
 	ok := op.Atxn.Op.CommitWait(wait)
+	if ok && flush {
+		op.Fs.Pending.flushed(seq)
+	}
 	op.postCommit()
 	return ok
 }
@@ -21,22 +32,36 @@ func (op *FsTxn) Commit() bool {
 	return op.commitWait(true)
 }
 
-// Commit data, but will also commit everything else, since we don't
-// support log-by-pass writes.
+// Commit data, but will also commit everything else: data written
+// directly is on disk before the log commits, but other data and the
+// metadata to find it go through the log.
 func (op *FsTxn) CommitData() bool {
-	return op.Atxn.Op.CommitWait(true)
+	return op.commitWait(true)
 }
 
-// Commit transaction, but don't write to stable storage
-func (op *FsTxn) CommitUnstable() bool {
-	return op.commitWait(false)
+// Commit transaction, which wrote cnt bytes at off of inum, but don't
+// write to stable storage
+func (op *FsTxn) CommitUnstable(inum common.Inum, off uint64, cnt uint64) bool {
+	ok := op.commitWait(false)
+	if ok {
+		op.Fs.Pending.add(inum, off, cnt)
+	}
+	return ok
 }
 
-// Flush log. We don't have to flush data from other file handles, but
-// that is only an option if we do log-by-pass writes.
-func (op *FsTxn) CommitFh() bool {
+// Flush log, if an unstable write to [off, end) of inum may not be on
+// disk yet.  The log has no way to flush only that file's transactions,
+// so it flushes the others too.
+func (op *FsTxn) CommitFh(inum common.Inum, off uint64, end uint64) bool {
 	op.preCommit()
-	ok := op.Fs.Txn.Flush()
+	var ok = true
+	unstable, seq := op.Fs.Pending.Unstable(inum, off, end)
+	if unstable {
+		ok = op.Fs.Txn.Flush()
+		if ok {
+			op.Fs.Pending.flushed(seq)
+		}
+	}
 	op.postCommit()
 	return ok
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/lockmap"
 	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/cache"
 	"github.com/mit-pdos/go-nfsd/super"
 )
@@ -16,24 +17,36 @@ type FsState struct {
 	Txn     *obj.Log
 	Icache  *cache.Cache
 	Lockmap *lockmap.LockMap
-	Balloc  *alloc.Alloc
+	Balloc  *alloctxn.Alloc
 	Ialloc  *alloc.Alloc
+	Bcount  *alloctxn.Counter
+	Icount  *alloctxn.Counter
+	Freed   *alloctxn.Freed
+	Pending *Pending
 }
 
-func readBitmap(super *super.FsSuper, start common.Bnum, len uint64) []byte {
+// readBitmap reads through the log, because after recovery the log
+// may not have installed the latest bitmap blocks yet.
+func readBitmap(super *super.FsSuper, log *obj.Log, start common.Bnum, len uint64) []byte {
 	var bitmap []byte
 	for i := uint64(0); i < len; i++ {
-		blk := super.Disk.Read(uint64(start) + i)
-		bitmap = append(bitmap, blk...)
+		b := log.Load(super.Block2addr(start+common.Bnum(i)), common.NBITBLOCK)
+		bitmap = append(bitmap, b.Data...)
 	}
 	return bitmap
 }
 
-func MkFsState(super *super.FsSuper, log *obj.Log) *FsState {
-	balloc := alloc.MkAlloc(readBitmap(super, super.BitmapBlockStart(),
+// MkFsState makes the state of a file system with the blocks that
+// can't bypass its log in freed (see Freed)
+func MkFsState(super *super.FsSuper, log *obj.Log, freed *alloctxn.Freed) *FsState {
+	balloc := alloctxn.MkAlloc(readBitmap(super, log, super.BitmapBlockStart(),
 		super.NBlockBitmap))
-	ialloc := alloc.MkAlloc(readBitmap(super, super.BitmapInodeStart(),
+	ialloc := alloc.MkAlloc(readBitmap(super, log, super.BitmapInodeStart(),
 		super.NInodeBitmap))
+	// blocks before DataStart() and inode 0 are marked in use
+	bcount := alloctxn.MkCounter(uint64(super.MaxBnum()-super.DataStart()),
+		balloc.NumFree())
+	icount := alloctxn.MkCounter(uint64(super.NInode())-1, ialloc.NumFree())
 	icache := cache.MkCache(ICACHESZ)
 	st := &FsState{
 		Super:   super,
@@ -42,6 +55,10 @@ func MkFsState(super *super.FsSuper, log *obj.Log) *FsState {
 		Lockmap: lockmap.MkLockMap(),
 		Balloc:  balloc,
 		Ialloc:  ialloc,
+		Bcount:  bcount,
+		Icount:  icount,
+		Freed:   freed,
+		Pending: MkPending(),
 	}
 	return st
 }
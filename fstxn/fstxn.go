@@ -8,6 +8,7 @@ import (
 	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 //
@@ -25,7 +26,7 @@ func Begin(fsstate *FsState) *FsTxn {
 	op := &FsTxn{
 		Fs: fsstate,
 		Atxn: alloctxn.Begin(fsstate.Super, fsstate.Txn, fsstate.Balloc,
-			fsstate.Ialloc),
+			fsstate.Ialloc, fsstate.Bcount, fsstate.Icount, fsstate.Freed),
 		inodes: make(map[common.Inum]*inode.Inode),
 	}
 	return op
@@ -91,7 +92,7 @@ func (op *FsTxn) GetInodeLocked(inum common.Inum) *inode.Inode {
 	cslot := op.LockInode(inum)
 	if cslot.Obj == nil {
 		addr := op.Fs.Super.Inum2Addr(inum)
-		buf := op.Atxn.Op.ReadBuf(addr, common.INODESZ*8)
+		buf := op.Atxn.Op.ReadBuf(addr, super.INODESZ*8)
 		i := inode.Decode(buf, inum)
 		util.DPrintf(1, "GetInodeLocked # %v: read inode from disk\n", inum)
 		cslot.Obj = i
@@ -0,0 +1,123 @@
+package fstxn
+
+import (
+	"sync"
+
+	"github.com/mit-pdos/go-journal/common"
+)
+
+//
+// Pending tracks the byte ranges of files that unstable writes wrote
+// and that may not be on disk yet, so that COMMIT flushes the log only
+// if the file has such a write in its range.  The log doesn't say how
+// far it has written, but flushing it writes all transactions that
+// committed before the flush started, so each write gets a sequence
+// number when it commits, and a flush makes the writes up to the last
+// number before it durable.  Any flush counts: a COMMIT for another
+// file, or a synchronous commit of another operation, spares the
+// file's COMMIT a flush.  The writes are also kept in order of their
+// sequence numbers, so that a flush forgets the ones it made durable
+// without looking at the others.
+//
+
+type pendingWrite struct {
+	off uint64
+	end uint64
+	seq uint64
+}
+
+type pendingSeq struct {
+	inum common.Inum
+	seq  uint64
+}
+
+type Pending struct {
+	mu      *sync.Mutex
+	seq     uint64                         // sequence number of the last unstable write
+	durable uint64                         // writes up to durable are on disk
+	writes  map[common.Inum][]pendingWrite // in order of seq
+	queue   []pendingSeq                   // writes of all files in order of seq
+}
+
+func MkPending() *Pending {
+	return &Pending{
+		mu:      new(sync.Mutex),
+		seq:     0,
+		durable: 0,
+		writes:  make(map[common.Inum][]pendingWrite),
+		queue:   make([]pendingSeq, 0),
+	}
+}
+
+// add records that an unstable write of cnt bytes at off of inum has
+// committed.  A write that overlaps or follows the last one of inum
+// extends it, which delays that one's durability to the new write's;
+// the queue entry for its old sequence number is then stale.
+func (p *Pending) add(inum common.Inum, off uint64, cnt uint64) {
+	p.mu.Lock()
+	p.seq = p.seq + 1
+	ws := p.writes[inum]
+	n := len(ws)
+	if n > 0 && off <= ws[n-1].end && off+cnt >= ws[n-1].off {
+		if off < ws[n-1].off {
+			ws[n-1].off = off
+		}
+		if off+cnt > ws[n-1].end {
+			ws[n-1].end = off + cnt
+		}
+		ws[n-1].seq = p.seq
+	} else {
+		p.writes[inum] = append(ws, pendingWrite{off: off, end: off + cnt, seq: p.seq})
+	}
+	p.queue = append(p.queue, pendingSeq{inum: inum, seq: p.seq})
+	p.mu.Unlock()
+}
+
+// Unstable returns whether an unstable write of inum to [off, end) may
+// not be durable yet, and the sequence number that a flush started now
+// makes durable
+func (p *Pending) Unstable(inum common.Inum, off uint64, end uint64) (bool, uint64) {
+	p.mu.Lock()
+	var unstable = false
+	for _, w := range p.writes[inum] {
+		if w.off < end && off < w.end {
+			unstable = true
+			break
+		}
+	}
+	seq := p.seq
+	p.mu.Unlock()
+	return unstable, seq
+}
+
+// last returns the sequence number that a flush started now makes
+// durable
+func (p *Pending) last() uint64 {
+	p.mu.Lock()
+	seq := p.seq
+	p.mu.Unlock()
+	return seq
+}
+
+// flushed records that the writes up to seq are durable, and forgets
+// them.  A file's writes are in order of seq too, so the write at the
+// front of the queue, unless stale, is its file's first.
+func (p *Pending) flushed(seq uint64) {
+	p.mu.Lock()
+	if seq > p.durable {
+		p.durable = seq
+		for len(p.queue) > 0 && p.queue[0].seq <= seq {
+			q := p.queue[0]
+			ws := p.writes[q.inum]
+			if len(ws) > 0 && ws[0].seq == q.seq {
+				if len(ws) == 1 {
+					delete(p.writes, q.inum)
+				} else {
+					p.writes[q.inum] = ws[1:]
+				}
+			}
+			p.queue = p.queue[1:]
+		}
+	}
+	p.mu.Unlock()
+}
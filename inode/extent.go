@@ -0,0 +1,326 @@
+package inode
+
+import (
+	"sort"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+)
+
+//
+// Extent trees.  An EXTENTS inode maps runs of logical blocks to runs
+// of physical blocks with a B+tree of extents, whose root is inside the
+// inode in place of blks:
+//
+//   node:  depth, # entries, and sorted entries (off, bn, len)
+//   leaf:  depth 0; an entry maps logical blocks [off, off+len) to
+//          physical blocks [bn, bn+len)
+//   inner: depth > 0; an entry's child node holds the extents in
+//          [off, next entry's off)
+//
+// The first entry of the leftmost inner nodes has off 0.  A write
+// allocates the blocks for its holes as one run, which usually extends
+// the last extent, so a large sequential file needs a few extents.
+// When the root is full, its entries move to a new node and the root
+// gets one level deeper; other full nodes split in half.  Shrinking
+// frees the last extent one run at a time, removes empty nodes, and
+// moves a single child into the root if it fits.
+//
+
+const (
+	EXTHDRSZ   uint64 = 16
+	EXTENTSZ   uint64 = 24
+	NROOTEXT   uint64 = (INLINESZ - EXTHDRSZ) / EXTENTSZ       // # entries in the root
+	NEXT       uint64 = (disk.BlockSize - EXTHDRSZ) / EXTENTSZ // # entries in a node
+	MAXEXTSIZE uint64 = 1 << 44                                // max size of an EXTENTS file
+	MAXEXTFREE uint64 = common.NBITBLOCK                       // # blocks freed per step
+)
+
+type extent struct {
+	off uint64      // first logical block
+	bn  common.Bnum // first physical block, or the child of an inner node
+	len uint64      // # blocks, 0 in an inner node
+}
+
+type extNode struct {
+	depth uint64 // 0 for a leaf
+	ents  []extent
+}
+
+func (ip *Inode) isExtents() bool {
+	return ip.Flags&EXTENTS != 0
+}
+
+func decodeExt(data []byte) *extNode {
+	dec := marshal.NewDec(data)
+	nd := &extNode{depth: dec.GetInt()}
+	n := dec.GetInt()
+	nd.ents = make([]extent, n)
+	for i := uint64(0); i < n; i++ {
+		nd.ents[i].off = dec.GetInt()
+		nd.ents[i].bn = dec.GetInt()
+		nd.ents[i].len = dec.GetInt()
+	}
+	return nd
+}
+
+func (nd *extNode) encode(sz uint64) []byte {
+	enc := marshal.NewEnc(sz)
+	enc.PutInt(nd.depth)
+	enc.PutInt(uint64(len(nd.ents)))
+	for _, e := range nd.ents {
+		enc.PutInt(e.off)
+		enc.PutInt(e.bn)
+		enc.PutInt(e.len)
+	}
+	return enc.Finish()
+}
+
+// find returns the index of the last entry with off at most off, or -1
+func (nd *extNode) find(off uint64) int {
+	return sort.Search(len(nd.ents), func(i int) bool {
+		return nd.ents[i].off > off
+	}) - 1
+}
+
+func (nd *extNode) insert(i int, e extent) {
+	nd.ents = append(nd.ents, extent{})
+	copy(nd.ents[i+1:], nd.ents[i:])
+	nd.ents[i] = e
+}
+
+func (nd *extNode) remove(i int) {
+	nd.ents = append(nd.ents[:i], nd.ents[i+1:]...)
+}
+
+// readExt returns the node in block bn, or the root if bn is NULLBNUM
+func (ip *Inode) readExt(atxn *alloctxn.AllocTxn, bn common.Bnum) *extNode {
+	if bn == common.NULLBNUM {
+		return decodeExt(ip.extroot)
+	}
+	return decodeExt(atxn.ReadBlock(bn).Data)
+}
+
+// writeExt writes nd to block bn, or to the root if bn is NULLBNUM;
+// the caller writes the inode.
+func (ip *Inode) writeExt(atxn *alloctxn.AllocTxn, bn common.Bnum, nd *extNode) {
+	if bn == common.NULLBNUM {
+		ip.extroot = nd.encode(INLINESZ)
+		return
+	}
+	atxn.WriteBlock(bn, nd.encode(disk.BlockSize))
+}
+
+func extCap(bn common.Bnum) uint64 {
+	if bn == common.NULLBNUM {
+		return NROOTEXT
+	}
+	return NEXT
+}
+
+// extPath returns the blocks and nodes from the root to the leaf that
+// maps off, and the index of the entry for off in each node
+func (ip *Inode) extPath(atxn *alloctxn.AllocTxn, off uint64) ([]common.Bnum,
+	[]*extNode, []int) {
+	var bn = common.NULLBNUM
+	var nd = ip.readExt(atxn, bn)
+	bns := []common.Bnum{bn}
+	nds := []*extNode{nd}
+	idx := []int{nd.find(off)}
+	for nd.depth > 0 {
+		bn = nd.ents[idx[len(idx)-1]].bn
+		nd = ip.readExt(atxn, bn)
+		bns = append(bns, bn)
+		nds = append(nds, nd)
+		idx = append(idx, nd.find(off))
+	}
+	return bns, nds, idx
+}
+
+// extLookup returns the block for off, or NULLBNUM if off is a hole
+func (ip *Inode) extLookup(atxn *alloctxn.AllocTxn, off uint64) common.Bnum {
+	_, nds, idx := ip.extPath(atxn, off)
+	leaf := nds[len(nds)-1]
+	i := idx[len(idx)-1]
+	if i >= 0 && off < leaf.ents[i].off+leaf.ents[i].len {
+		return leaf.ents[i].bn + (off - leaf.ents[i].off)
+	}
+	return common.NULLBNUM
+}
+
+// extInsert maps the hole at off to block bn, extending the extent
+// before off if bn follows its last block.  It allocates the nodes for
+// splits up front, and fails if it can't.
+func (ip *Inode) extInsert(atxn *alloctxn.AllocTxn, off uint64, bn common.Bnum) bool {
+	bns, nds, idx := ip.extPath(atxn, off)
+	l := len(nds) - 1
+	i := idx[l]
+	if i >= 0 {
+		e := &nds[l].ents[i]
+		if e.off+e.len == off && e.bn+e.len == bn {
+			e.len = e.len + 1
+			ip.writeExt(atxn, bns[l], nds[l])
+			return true
+		}
+	}
+	var need uint64 = 0
+	for lvl := l; lvl >= 0; lvl-- {
+		if uint64(len(nds[lvl].ents)) < extCap(bns[lvl]) {
+			break
+		}
+		need = need + 1
+	}
+	nbns := ip.allocBlocks(atxn, need)
+	if uint64(len(nbns)) < need {
+		for _, nbn := range nbns {
+			ip.freeBlock(atxn, nbn)
+		}
+		return false
+	}
+	ip.extPut(atxn, bns, nds, idx, l, extent{off: off, bn: bn, len: 1}, nbns)
+	return true
+}
+
+// extPut inserts e after entry idx[lvl] of the node at lvl in the path,
+// splitting it with a new block from nbns if it overflows
+func (ip *Inode) extPut(atxn *alloctxn.AllocTxn, bns []common.Bnum, nds []*extNode,
+	idx []int, lvl int, e extent, nbns []common.Bnum) {
+	nd := nds[lvl]
+	nd.insert(idx[lvl]+1, e)
+	if uint64(len(nd.ents)) <= extCap(bns[lvl]) {
+		ip.writeExt(atxn, bns[lvl], nd)
+		return
+	}
+	nbn := nbns[0]
+	if lvl == 0 {
+		// the root moves into nbn and gets one level deeper
+		ip.writeExt(atxn, nbn, nd)
+		root := &extNode{depth: nd.depth + 1, ents: []extent{{off: 0, bn: nbn}}}
+		ip.writeExt(atxn, common.NULLBNUM, root)
+		return
+	}
+	mid := len(nd.ents) / 2
+	right := &extNode{depth: nd.depth, ents: make([]extent, len(nd.ents)-mid)}
+	copy(right.ents, nd.ents[mid:])
+	nd.ents = nd.ents[:mid]
+	ip.writeExt(atxn, bns[lvl], nd)
+	ip.writeExt(atxn, nbn, right)
+	ip.extPut(atxn, bns, nds, idx, lvl-1, extent{off: right.ents[0].off, bn: nbn},
+		nbns[1:])
+}
+
+// extAlloc allocates blocks for the holes that a write of count bytes
+// at offset fills as one run, in order, as far as there is space.  The
+// blocks that the write covers entirely may be marked to be written
+// directly; the others are zeroed.  It returns whether it allocated
+// any.
+func (ip *Inode) extAlloc(atxn *alloctxn.AllocTxn, offset uint64, count uint64) bool {
+	first := offset / disk.BlockSize
+	last := util.RoundUp(offset+count, disk.BlockSize)
+	holes := make([]uint64, 0)
+	for off := first; off < last; off++ {
+		if ip.extLookup(atxn, off) == common.NULLBNUM {
+			holes = append(holes, off)
+		}
+	}
+	bns := ip.allocBlocks(atxn, uint64(len(holes)))
+	for i, bn := range bns {
+		full := holes[i]*disk.BlockSize >= offset &&
+			(holes[i]+1)*disk.BlockSize <= offset+count
+		if !(full && atxn.MarkDirect(bn)) {
+			atxn.ZeroBlock(bn)
+		}
+	}
+	for i, bn := range bns {
+		if !ip.extInsert(atxn, holes[i], bn) {
+			for _, fbn := range bns[i:] {
+				ip.freeBlock(atxn, fbn)
+			}
+			return i > 0
+		}
+	}
+	return len(bns) > 0
+}
+
+// extBmap is bmap for an EXTENTS inode
+func (ip *Inode) extBmap(atxn *alloctxn.AllocTxn, off uint64) (common.Bnum, bool) {
+	bn := ip.extLookup(atxn, off)
+	if bn != common.NULLBNUM {
+		return bn, false
+	}
+	bn = ip.allocBlock(atxn)
+	if bn == common.NULLBNUM {
+		return bn, false
+	}
+	if !ip.extInsert(atxn, off, bn) {
+		ip.freeBlock(atxn, bn)
+		return common.NULLBNUM, false
+	}
+	return bn, true
+}
+
+// extShrink frees up to MAXEXTFREE blocks of the last extent at or
+// beyond the new size, skipping holes, and lowers ShrinkSize
+func (ip *Inode) extShrink(atxn *alloctxn.AllocTxn) {
+	newsz := util.RoundUp(ip.Size, disk.BlockSize)
+	bns, nds, idx := ip.extPath(atxn, ip.ShrinkSize-1)
+	l := len(nds) - 1
+	i := idx[l]
+	if i < 0 {
+		ip.ShrinkSize = newsz
+		return
+	}
+	e := &nds[l].ents[i]
+	end := util.Min(ip.ShrinkSize, e.off+e.len)
+	if end <= newsz {
+		ip.ShrinkSize = newsz
+		return
+	}
+	var start = newsz
+	if e.off > start {
+		start = e.off
+	}
+	if end-start > MAXEXTFREE {
+		start = end - MAXEXTFREE
+	}
+	for off := start; off < end; off++ {
+		ip.freeBlock(atxn, e.bn+(off-e.off))
+	}
+	e.len = start - e.off
+	ip.ShrinkSize = start
+	if e.len > 0 {
+		ip.writeExt(atxn, bns[l], nds[l])
+		return
+	}
+	nds[l].remove(i)
+	var lvl = l
+	for lvl > 0 && len(nds[lvl].ents) == 0 {
+		ip.freeBlock(atxn, bns[lvl])
+		lvl = lvl - 1
+		nds[lvl].remove(idx[lvl])
+	}
+	if lvl == 0 && len(nds[0].ents) == 0 {
+		nds[0].depth = 0
+	}
+	ip.writeExt(atxn, bns[lvl], nds[lvl])
+	ip.extCollapse(atxn)
+}
+
+// extCollapse moves the root's only child into the root, if it fits
+func (ip *Inode) extCollapse(atxn *alloctxn.AllocTxn) {
+	root := ip.readExt(atxn, common.NULLBNUM)
+	for root.depth > 0 && len(root.ents) == 1 {
+		bn := root.ents[0].bn
+		child := ip.readExt(atxn, bn)
+		if uint64(len(child.ents)) > NROOTEXT {
+			break
+		}
+		ip.freeBlock(atxn, bn)
+		root = child
+		ip.writeExt(atxn, common.NULLBNUM, root)
+	}
+}
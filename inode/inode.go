@@ -13,19 +13,45 @@ import (
 	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/dcache"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 const NF3FREE nfstypes.Ftype3 = 0
 
 const (
-	NBLKINO   uint64 = 10 // # blk in an inode's blks array
-	NDIRECT   uint64 = NBLKINO - 2
-	INDIRECT  uint64 = NBLKINO - 2
-	DINDIRECT uint64 = NBLKINO - 1
+	NBLKINO   uint64 = 11 // # blk in an inode's blks array
+	NDIRECT   uint64 = NBLKINO - 3
+	INDIRECT  uint64 = NBLKINO - 3
+	DINDIRECT uint64 = NBLKINO - 2
+	TINDIRECT uint64 = NBLKINO - 1
 	NBLKBLK   uint64 = disk.BlockSize / 8 // # blkno per block
-	NINDLEVEL uint64 = 2                  // # levels of indirection
+	NINDLEVEL uint64 = 3                  // # levels of indirection
+	MAXNLINK  uint32 = 65000              // # hard links to an inode
+	MODEMASK  uint32 = 07777              // permission, setuid, setgid, sticky bits
+	MODEDEF   uint32 = 0777               // mode if creator doesn't supply one
 )
 
+// Flags
+const (
+	INDEXED uint32 = 1 // directory in the indexed format (see dir)
+	INLINE  uint32 = 2 // file or symlink data inside the inode
+	EXTENTS uint32 = 4 // blocks mapped by an extent tree (see extent.go)
+)
+
+// the on-disk inode before blks
+const INODEHDRSZ uint64 = 4 + 4 + 8 + 8 + // kind, nlink, gen, size
+	8 + 8 + // shrinksize, nblocks
+	(3 * 8) + // atime, mtime, ctime
+	4 + 4 + 4 + // mode, uid, gid
+	8 + 4 + 8 // rdev, flags, dirgen
+
+// An INLINE inode stores the first INLINESZ bytes of the file in place
+// of blks and has no blocks; the rest of the file, if any, is a hole.
+// Writing beyond INLINESZ moves the data to a block, and the inode to
+// EXTENTS, whose extent tree root takes the same space, or, if the file
+// system's BlockMap is set, to blks.
+const INLINESZ uint64 = super.INODESZ - INODEHDRSZ
+
 type Inode struct {
 	// in-memory info:
 	Inum   common.Inum
@@ -41,9 +67,24 @@ type Inode struct {
 	// of shrinking to Size. ShrinkSize is in block units
 	ShrinkSize uint64
 
+	// # blocks allocated to the inode, including index blocks
+	NBlocks uint64
+
 	Atime nfstypes.Nfstime3
 	Mtime nfstypes.Nfstime3
-	blks  []common.Bnum
+	Ctime nfstypes.Nfstime3
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Rdev  nfstypes.Specdata3 // major and minor of a device
+	Flags uint32
+
+	// a directory's READDIR cookies are valid for one DirGen
+	DirGen uint64
+
+	blks    []common.Bnum
+	inline  []byte // INLINESZ bytes, if INLINE
+	extroot []byte // INLINESZ bytes, if EXTENTS
 }
 
 func NfstimeNow() nfstypes.Nfstime3 {
@@ -62,7 +103,20 @@ func (ip *Inode) InitInode(inum common.Inum, kind nfstypes.Ftype3) {
 	ip.Nlink = 1
 	ip.Gen = ip.Gen + 1
 	ip.Atime = NfstimeNow()
-	ip.Mtime = NfstimeNow()
+	ip.Mtime = ip.Atime
+	ip.Ctime = ip.Atime
+	ip.Mode = MODEDEF
+	ip.Uid = 0
+	ip.Gid = 0
+	ip.Rdev = nfstypes.Specdata3{}
+	ip.Flags = 0
+	ip.DirGen = 0
+	ip.inline = nil
+	ip.extroot = nil
+	if kind == nfstypes.NF3REG || kind == nfstypes.NF3LNK {
+		ip.Flags = INLINE
+		ip.inline = make([]byte, INLINESZ)
+	}
 }
 
 func MkRootInode() *Inode {
@@ -73,41 +127,91 @@ func MkRootInode() *Inode {
 }
 
 func (ip *Inode) String() string {
-	return fmt.Sprintf("# %d k %d n %d g %d sz %d ssz %d %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size, ip.ShrinkSize, ip.blks)
+	return fmt.Sprintf("# %d k %d n %d g %d sz %d ssz %d nb %d m %o u %d g %d f %x %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size, ip.ShrinkSize, ip.NBlocks, ip.Mode, ip.Uid, ip.Gid, ip.Flags, ip.blks)
 }
 
 func (ip *Inode) MkFattr() nfstypes.Fattr3 {
 	return nfstypes.Fattr3{
-		Ftype: ip.Kind,
-		Mode:  0777,
-		Nlink: 1,
-		Uid:   nfstypes.Uid3(0),
-		Gid:   nfstypes.Gid3(0),
-		Size:  nfstypes.Size3(ip.Size),
-		Used:  nfstypes.Size3(ip.Size),
-		Rdev: nfstypes.Specdata3{Specdata1: nfstypes.Uint32(0),
-			Specdata2: nfstypes.Uint32(0)},
+		Ftype:  ip.Kind,
+		Mode:   nfstypes.Mode3(ip.Mode),
+		Nlink:  nfstypes.Uint32(ip.Nlink),
+		Uid:    nfstypes.Uid3(ip.Uid),
+		Gid:    nfstypes.Gid3(ip.Gid),
+		Size:   nfstypes.Size3(ip.Size),
+		Used:   nfstypes.Size3(ip.NBlocks * disk.BlockSize),
+		Rdev:   ip.Rdev,
 		Fsid:   nfstypes.Uint64(0),
 		Fileid: nfstypes.Fileid3(ip.Inum),
 		Atime:  ip.Atime,
 		Mtime:  ip.Mtime,
-		Ctime: nfstypes.Nfstime3{Seconds: nfstypes.Uint32(0),
-			Nseconds: nfstypes.Uint32(0)},
+		Ctime:  ip.Ctime,
+	}
+}
+
+// Modified records that ip's contents changed; the caller writes the
+// inode.
+func (ip *Inode) Modified() {
+	ip.Mtime = NfstimeNow()
+	ip.Ctime = ip.Mtime
+}
+
+// SetAttr applies the mode, owner, and time attributes in sattr; the
+// caller handles size, because shrinking may need the shrinker.
+func (ip *Inode) SetAttr(atxn *alloctxn.AllocTxn, sattr nfstypes.Sattr3) {
+	if sattr.Size.Set_it {
+		ip.Modified()
+	}
+	ip.Ctime = NfstimeNow()
+	if sattr.Mode.Set_it {
+		ip.Mode = uint32(sattr.Mode.Mode) & MODEMASK
+	}
+	if sattr.Uid.Set_it {
+		ip.Uid = uint32(sattr.Uid.Uid)
 	}
+	if sattr.Gid.Set_it {
+		ip.Gid = uint32(sattr.Gid.Gid)
+	}
+	if sattr.Atime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
+		ip.Atime = sattr.Atime.Atime
+	} else if sattr.Atime.Set_it == nfstypes.SET_TO_SERVER_TIME {
+		ip.Atime = NfstimeNow()
+	}
+	if sattr.Mtime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
+		ip.Mtime = sattr.Mtime.Mtime
+	} else if sattr.Mtime.Set_it == nfstypes.SET_TO_SERVER_TIME {
+		ip.Mtime = NfstimeNow()
+	}
+	ip.WriteInode(atxn)
 }
 
 func (ip *Inode) Encode() []byte {
-	enc := marshal.NewEnc(common.INODESZ)
+	enc := marshal.NewEnc(super.INODESZ)
 	enc.PutInt32(uint32(ip.Kind))
 	enc.PutInt32(ip.Nlink)
 	enc.PutInt(ip.Gen)
 	enc.PutInt(ip.Size)
 	enc.PutInt(ip.ShrinkSize)
+	enc.PutInt(ip.NBlocks)
 	enc.PutInt32(uint32(ip.Atime.Seconds))
 	enc.PutInt32(uint32(ip.Atime.Nseconds))
 	enc.PutInt32(uint32(ip.Mtime.Seconds))
 	enc.PutInt32(uint32(ip.Mtime.Nseconds))
-	enc.PutInts(ip.blks)
+	enc.PutInt32(uint32(ip.Ctime.Seconds))
+	enc.PutInt32(uint32(ip.Ctime.Nseconds))
+	enc.PutInt32(ip.Mode)
+	enc.PutInt32(ip.Uid)
+	enc.PutInt32(ip.Gid)
+	enc.PutInt32(uint32(ip.Rdev.Specdata1))
+	enc.PutInt32(uint32(ip.Rdev.Specdata2))
+	enc.PutInt32(ip.Flags)
+	enc.PutInt(ip.DirGen)
+	if ip.isInline() {
+		enc.PutBytes(ip.inline)
+	} else if ip.isExtents() {
+		enc.PutBytes(ip.extroot)
+	} else {
+		enc.PutInts(ip.blks)
+	}
 	return enc.Finish()
 }
 
@@ -120,11 +224,31 @@ func Decode(buf *buf.Buf, inum common.Inum) *Inode {
 	ip.Gen = dec.GetInt()
 	ip.Size = dec.GetInt()
 	ip.ShrinkSize = dec.GetInt()
+	ip.NBlocks = dec.GetInt()
 	ip.Atime.Seconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Atime.Nseconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Seconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Nseconds = nfstypes.Uint32(dec.GetInt32())
-	ip.blks = dec.GetInts(NBLKINO)
+	ip.Ctime.Seconds = nfstypes.Uint32(dec.GetInt32())
+	ip.Ctime.Nseconds = nfstypes.Uint32(dec.GetInt32())
+	ip.Mode = dec.GetInt32()
+	ip.Uid = dec.GetInt32()
+	ip.Gid = dec.GetInt32()
+	ip.Rdev.Specdata1 = nfstypes.Uint32(dec.GetInt32())
+	ip.Rdev.Specdata2 = nfstypes.Uint32(dec.GetInt32())
+	ip.Flags = dec.GetInt32()
+	ip.DirGen = dec.GetInt()
+	if ip.isInline() {
+		ip.inline = make([]byte, INLINESZ)
+		copy(ip.inline, dec.GetBytes(INLINESZ))
+		ip.blks = make([]common.Bnum, NBLKINO)
+	} else if ip.isExtents() {
+		ip.extroot = make([]byte, INLINESZ)
+		copy(ip.extroot, dec.GetBytes(INLINESZ))
+		ip.blks = make([]common.Bnum, NBLKINO)
+	} else {
+		ip.blks = dec.GetInts(NBLKINO)
+	}
 	return ip
 }
 
@@ -134,14 +258,45 @@ func pow(level uint64) uint64 {
 	}
 	var p uint64 = NBLKBLK
 	for i := uint64(1); i < level; i++ {
-		p = p * p
+		p = p * NBLKBLK
 	}
 	return p
 }
 
+// indLevel returns the index in blks of the index tree that maps block
+// bn, which is beyond the direct blocks, the tree's level, and the
+// offset of bn in the tree
+func indLevel(bn uint64) (uint64, uint64, uint64) {
+	var off = bn - NDIRECT
+	var level uint64 = 1
+	for off >= pow(level) {
+		off = off - pow(level)
+		level = level + 1
+	}
+	return INDIRECT + level - 1, level, off
+}
+
+// MaxFileSize is the largest file size, that of EXTENTS files
 func MaxFileSize() uint64 {
-	maxblks := pow(NINDLEVEL)
-	return (NDIRECT + maxblks) * disk.BlockSize
+	return MAXEXTSIZE
+}
+
+// MaxBmapSize is the largest size of a file mapped with blks
+func MaxBmapSize() uint64 {
+	var maxblks = NDIRECT
+	for level := uint64(1); level <= NINDLEVEL; level++ {
+		maxblks = maxblks + pow(level)
+	}
+	return maxblks * disk.BlockSize
+}
+
+// maxSize is the largest size of ip; an INLINE inode becomes EXTENTS
+// unless the file system maps new files with blks
+func (ip *Inode) maxSize(atxn *alloctxn.AllocTxn) uint64 {
+	if ip.isExtents() || (ip.isInline() && !atxn.Super.BlockMap) {
+		return MAXEXTSIZE
+	}
+	return MaxBmapSize()
 }
 
 func (ip *Inode) WriteInode(atxn *alloctxn.AllocTxn) {
@@ -149,7 +304,7 @@ func (ip *Inode) WriteInode(atxn *alloctxn.AllocTxn) {
 		panic("WriteInode")
 	}
 	d := ip.Encode()
-	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), common.INODESZ*8, d)
+	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), super.INODESZ*8, d)
 	util.DPrintf(1, "WriteInode %v\n", ip)
 }
 
@@ -165,6 +320,10 @@ func (ip *Inode) FreeInode(atxn *alloctxn.AllocTxn) {
 // transaction, if shrinking involves freeing many blocks.  ShrinkSize
 // tracks shrinking progress, and is initialized with the old size.
 func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
+	if ip.isInline() {
+		ip.resizeInline(atxn, sz)
+		return false
+	}
 	var newSz = sz
 	var doshrink = false
 	oldsz := util.RoundUp(ip.Size, disk.BlockSize)
@@ -178,7 +337,11 @@ func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
 	}
 	ip.WriteInode(atxn)
 	if newSz < oldsz {
-		if ip.shrinkFits(atxn, oldsz-newSz) {
+		if ip.isExtents() {
+			// the cost of a step depends on the extent tree, so free
+			// what fits and leave the rest to another transaction
+			doshrink = ip.Shrink(atxn)
+		} else if ip.shrinkFits(atxn, oldsz-newSz) {
 			ip.Shrink(atxn)
 			util.DPrintf(1, "small file delete inside trans\n")
 		} else {
@@ -188,13 +351,91 @@ func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
 	return doshrink
 }
 
+func (ip *Inode) isInline() bool {
+	return ip.Flags&INLINE != 0
+}
+
+// resizeInline zeroes the inline bytes beyond sz, which has no blocks to
+// free.
+func (ip *Inode) resizeInline(atxn *alloctxn.AllocTxn, sz uint64) {
+	for i := sz; i < INLINESZ; i++ {
+		ip.inline[i] = 0
+	}
+	ip.Size = sz
+	ip.ShrinkSize = util.RoundUp(sz, disk.BlockSize)
+	ip.WriteInode(atxn)
+}
+
+// readInline returns count bytes at offset of an inline file
+func (ip *Inode) readInline(offset uint64, count uint64) []byte {
+	data := make([]byte, count)
+	if offset < INLINESZ {
+		copy(data, ip.inline[offset:util.Min(INLINESZ, offset+count)])
+	}
+	return data
+}
+
+// unInline moves the data of an inline file to block 0, if it has any,
+// and makes ip an EXTENTS inode, unless the file system maps new files
+// with blks
+func (ip *Inode) unInline(atxn *alloctxn.AllocTxn) bool {
+	var bn = common.NULLBNUM
+	if ip.Size > 0 {
+		bn = ip.allocBlock(atxn)
+		if bn == common.NULLBNUM {
+			return false
+		}
+		data := make([]byte, disk.BlockSize)
+		copy(data, ip.inline)
+		atxn.WriteBlock(bn, data)
+	}
+	util.DPrintf(1, "unInline # %v: sz %d\n", ip.Inum, ip.Size)
+	ip.Flags = ip.Flags &^ INLINE
+	ip.inline = nil
+	if atxn.Super.BlockMap {
+		ip.blks[0] = bn
+		return true
+	}
+	root := &extNode{depth: 0, ents: make([]extent, 0)}
+	if bn != common.NULLBNUM {
+		root.ents = append(root.ents, extent{off: 0, bn: bn, len: 1})
+	}
+	ip.Flags = ip.Flags | EXTENTS
+	ip.writeExt(atxn, common.NULLBNUM, root)
+	return true
+}
+
+// allocBlock allocates a block for ip, counting it in NBlocks
+func (ip *Inode) allocBlock(atxn *alloctxn.AllocTxn) common.Bnum {
+	bn := atxn.AllocBlock()
+	if bn != common.NULLBNUM {
+		ip.NBlocks = ip.NBlocks + 1
+	}
+	return bn
+}
+
+// allocBlocks allocates a run of up to n blocks for ip
+func (ip *Inode) allocBlocks(atxn *alloctxn.AllocTxn, n uint64) []common.Bnum {
+	bns := atxn.AllocBlocks(n)
+	ip.NBlocks = ip.NBlocks + uint64(len(bns))
+	return bns
+}
+
+// freeBlock frees a block of ip, if any
+func (ip *Inode) freeBlock(atxn *alloctxn.AllocTxn, bn common.Bnum) {
+	if bn != common.NULLBNUM {
+		atxn.FreeBlock(bn)
+		ip.NBlocks = ip.NBlocks - 1
+	}
+}
+
 // Returns blkno and root index block for off. If blkno is 0, failure.
 // Caller must compare root with returned root to decide if a root has
 // been allocated.
 func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint64, off uint64) (common.Bnum, common.Bnum) {
 	var root = root_
 	if root == common.NULLBNUM { // no root?
-		root = atxn.AllocBlock()
+		root = ip.allocBlock(atxn)
 		if root == common.NULLBNUM {
 			return root, root
 		}
@@ -225,40 +466,58 @@ func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint6
 func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, bool) {
 	var blkno = common.NULLBNUM
 	var alloc = false
+	if ip.isExtents() {
+		return ip.extBmap(atxn, bn)
+	}
 	if bn < NDIRECT {
 		if ip.blks[bn] == common.NULLBNUM {
-			ip.blks[bn] = atxn.AllocBlock()
+			ip.blks[bn] = ip.allocBlock(atxn)
 			if ip.blks[bn] != common.NULLBNUM {
 				alloc = true
 			}
 		}
 		blkno = ip.blks[bn]
 	} else {
-		var off = bn - NDIRECT
-		var root = common.NULLBNUM
-		if off < NBLKBLK {
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[INDIRECT], 1, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[INDIRECT] = root
-			}
-		} else {
-			off -= NBLKBLK
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[DINDIRECT], 2, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[DINDIRECT] = root
-			}
+		i, level, off := indLevel(bn)
+		newBlkno, newRoot := ip.indbmap(atxn, ip.blks[i], level, off)
+		blkno = newBlkno
+		alloc = newRoot != ip.blks[i]
+		if alloc {
+			ip.blks[i] = newRoot
 		}
 	}
 	return blkno, alloc
 }
 
-// Returns number of bytes read and eof
+// Returns the block number for off in the index tree at root, or
+// NULLBNUM if off falls in a hole.
+func (ip *Inode) indlookup(atxn *alloctxn.AllocTxn, root common.Bnum, level uint64, off uint64) common.Bnum {
+	if root == common.NULLBNUM || level == 0 {
+		return root
+	}
+	divisor := pow(level - 1)
+	o := off / divisor
+	ind := off % divisor
+	buf := atxn.ReadBlock(root)
+	nxtroot := buf.BnumGet(o * 8)
+	return ip.indlookup(atxn, nxtroot, level-1, ind)
+}
+
+// Map logical block number bn to a physical block number, like bmap,
+// but without allocating. Returns NULLBNUM if bn is a hole.
+func (ip *Inode) lookup(atxn *alloctxn.AllocTxn, bn uint64) common.Bnum {
+	if ip.isExtents() {
+		return ip.extLookup(atxn, bn)
+	}
+	if bn < NDIRECT {
+		return ip.blks[bn]
+	}
+	i, level, off := indLevel(bn)
+	return ip.indlookup(atxn, ip.blks[i], level, off)
+}
+
+// Returns number of bytes read and eof. Holes read as zeros, and
+// reading doesn't modify the inode.
 func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64) ([]byte,
 	bool) {
 	var n uint64 = uint64(0)
@@ -271,22 +530,20 @@ func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64
 		count = ip.Size - offset
 	}
 	util.DPrintf(5, "Read: off %d cnt %d\n", offset, count)
-	var data = make([]byte, 0)
+	if ip.isInline() {
+		return ip.readInline(offset, count), false
+	}
+	var data = make([]byte, 0, count)
 	var off = offset
 	for boff := off / disk.BlockSize; n < count; boff++ {
 		byteoff := off % disk.BlockSize
 		nbytes := util.Min(disk.BlockSize-byteoff, count-n)
-		blkno, alloc := ip.bmap(atxn, boff)
-		if blkno == common.NULLBNUM {
-			break
-		}
-		if alloc { // fill in a hole
-			ip.WriteInode(atxn)
-		}
-		buf := atxn.ReadBlock(blkno)
-
-		for b := uint64(0); b < nbytes; b++ {
-			data = append(data, buf.Data[byteoff+b])
+		blkno := ip.lookup(atxn, boff)
+		if blkno == common.NULLBNUM { // a hole
+			data = append(data, make([]byte, nbytes)...)
+		} else {
+			buf := atxn.ReadBlock(blkno)
+			data = append(data, buf.Data[byteoff:byteoff+nbytes]...)
 		}
 		n += nbytes
 		off += nbytes
@@ -306,9 +563,21 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	var data = dataBuf
 
 	util.DPrintf(5, "Write: off %d cnt %d\n", offset, count)
-	if offset+count > MaxFileSize() {
+	if offset+count > ip.maxSize(atxn) {
 		return 0, false
 	}
+	if ip.isInline() {
+		if offset+count <= INLINESZ {
+			copy(ip.inline[offset:], data[:count])
+			return ip.wrote(atxn, offset, count), true
+		}
+		if !ip.unInline(atxn) {
+			return 0, false
+		}
+	}
+	if ip.isExtents() && count > 0 {
+		alloc = ip.extAlloc(atxn, offset, count)
+	}
 	for boff := off / disk.BlockSize; n > uint64(0); boff++ {
 		blkno, new := ip.bmap(atxn, boff)
 		if blkno == common.NULLBNUM {
@@ -324,8 +593,7 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 			nbytes = n
 		}
 		if byteoff == 0 && nbytes == disk.BlockSize { // block overwrite?
-			addr := atxn.Super.Block2addr(blkno)
-			atxn.Op.OverWrite(addr, common.NBITBLOCK, data[0:nbytes])
+			atxn.WriteBlock(blkno, data[0:nbytes])
 		} else {
 			buffer := atxn.ReadBlock(blkno)
 			for b := uint64(0); b < nbytes; b++ {
@@ -340,17 +608,34 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	}
 	util.DPrintf(1, "Write: off %d cnt %d size %d\n", offset, cnt, ip.Size)
 	if alloc || cnt > 0 {
-		if offset+cnt > ip.Size {
-			ip.Size = offset + cnt
-		}
-		ip.WriteInode(atxn)
-		return cnt, true
+		return ip.wrote(atxn, offset, cnt), true
 	}
 	return cnt, ok
 }
 
+// wrote updates ip after writing cnt bytes at offset
+func (ip *Inode) wrote(atxn *alloctxn.AllocTxn, offset uint64, cnt uint64) uint64 {
+	if offset+cnt > ip.Size {
+		ip.Size = offset + cnt
+	}
+	ip.Modified()
+	ip.WriteInode(atxn)
+	return cnt
+}
+
+func (ip *Inode) IncLink(atxn *alloctxn.AllocTxn) bool {
+	if ip.Nlink >= MAXNLINK {
+		return false
+	}
+	ip.Nlink = ip.Nlink + 1
+	ip.Ctime = NfstimeNow()
+	ip.WriteInode(atxn)
+	return true
+}
+
 func (ip *Inode) DecLink(atxn *alloctxn.AllocTxn) bool {
 	ip.Nlink = ip.Nlink - 1
+	ip.Ctime = NfstimeNow()
 	ip.WriteInode(atxn)
 	return ip.Nlink == 0
 }
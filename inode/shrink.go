@@ -14,10 +14,23 @@ import (
 // transactions to ensure that the indirect blocks modified due to a
 // free fit in the write-ahead log.  In this case the caller of
 // Shrink() is responsible for starting another shrink transaction.
+// An EXTENTS inode frees a run of blocks per step, whose bits share one
+// or two bitmap blocks.
 //
 
 func (ip *Inode) shrinkFits(op *alloctxn.AllocTxn, nblk uint64) bool {
-	return op.Op.NDirty()+nblk < jrnl.LogBlocks
+	return op.NDirty()+nblk < jrnl.LogBlocks
+}
+
+// ShrinkFits returns whether Resize can free the blocks beyond sz inside
+// the transaction, after the caller writes ndirty more blocks.
+func (ip *Inode) ShrinkFits(op *alloctxn.AllocTxn, sz uint64, ndirty uint64) bool {
+	oldsz := util.RoundUp(ip.Size, disk.BlockSize)
+	newsz := util.RoundUp(sz, disk.BlockSize)
+	if newsz >= oldsz {
+		return true
+	}
+	return ip.shrinkFits(op, 5*(oldsz-newsz)+ndirty)
 }
 
 func (ip *Inode) IsShrinking() bool {
@@ -26,19 +39,38 @@ func (ip *Inode) IsShrinking() bool {
 	return s
 }
 
+// NeedsReclaim returns whether ip is shrinking, or is free but still
+// owns blocks, which a crash may leave behind
+func (ip *Inode) NeedsReclaim() bool {
+	return ip.IsShrinking() || (ip.Kind == NF3FREE && ip.NBlocks > 0)
+}
+
+// Reclaim makes a free inode that still owns blocks, but isn't
+// shrinking, shrink to size 0 from the end of its block map, so that
+// Shrink frees all its blocks.  It returns whether ip needs Shrink.
+func (ip *Inode) Reclaim(atxn *alloctxn.AllocTxn) bool {
+	if ip.Kind == NF3FREE && ip.NBlocks > 0 && !ip.IsShrinking() {
+		ip.Size = 0
+		ip.ShrinkSize = ip.maxSize(atxn) / disk.BlockSize
+		ip.WriteInode(atxn)
+	}
+	return ip.IsShrinking()
+}
+
 func (ip *Inode) freeIndex(op *alloctxn.AllocTxn, index uint64) {
-	op.FreeBlock(ip.blks[index])
+	ip.freeBlock(op, ip.blks[index])
 	ip.blks[index] = 0
 }
 
 // Frees indirect bn.  Assumes if bn is cleared, then all blocks > bn
-// have been cleared
-func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) common.Bnum {
+// have been cleared.  Returns root if the tree at root is now empty,
+// and the # blocks before bn that are in a hole, which need no freeing.
+func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) (common.Bnum, uint64) {
 	if root == common.NULLBNUM {
-		return 0
+		return 0, bn
 	}
 	if level == 0 {
-		return root
+		return root, 0
 	}
 	divisor := pow(level - 1)
 	off := (bn / divisor)
@@ -47,45 +79,64 @@ func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64
 	b := op.ReadBlock(root)
 	nxtroot := b.BnumGet(boff)
 	op.AssertValidBlock(nxtroot)
+	var skip = ind
+	var empty = true
 	if nxtroot != 0 {
-		freeroot := ip.indshrink(op, nxtroot, level-1, ind)
+		freeroot, s := ip.indshrink(op, nxtroot, level-1, ind)
+		skip = s
+		empty = freeroot != 0
 		if freeroot != 0 {
 			b.BnumPut(boff, 0)
-			op.FreeBlock(freeroot)
+			ip.freeBlock(op, freeroot)
 		}
 	}
-	if off == 0 && ind == 0 {
-		return root
+	if off == 0 && empty {
+		return root, skip
 	} else {
-		return common.NULLBNUM
+		return common.NULLBNUM, skip
 	}
 }
 
-// Frees as many blocks as possible, and returns if more shrinking is necessary.
-// 5: inode block, 2xbitmap block, indirect block, double indirect
+// Frees as many blocks as possible, and returns if more shrinking is
+// necessary.  Holes in the index trees are skipped.
+// 6: inode block, 2xbitmap block, indirect, double and triple indirect
 func (ip *Inode) Shrink(op *alloctxn.AllocTxn) bool {
-	util.DPrintf(1, "Shrink: from %d to %d\n", ip.ShrinkSize,
-		util.RoundUp(ip.Size, disk.BlockSize))
-	for ip.IsShrinking() && ip.shrinkFits(op, 5) {
+	newsz := util.RoundUp(ip.Size, disk.BlockSize)
+	util.DPrintf(1, "Shrink: from %d to %d\n", ip.ShrinkSize, newsz)
+	if ip.isExtents() {
+		return ip.shrinkExtents(op)
+	}
+	for ip.IsShrinking() && ip.shrinkFits(op, 6) {
 		ip.ShrinkSize -= 1
 		if ip.ShrinkSize < NDIRECT {
 			ip.freeIndex(op, ip.ShrinkSize)
 		} else {
-			var off = ip.ShrinkSize - NDIRECT
-			if off < NBLKBLK {
-				freeroot := ip.indshrink(op, ip.blks[INDIRECT], 1, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, INDIRECT)
-				}
-			} else {
-				off = off - NBLKBLK
-				freeroot := ip.indshrink(op, ip.blks[DINDIRECT], 2, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, DINDIRECT)
-				}
+			i, level, off := indLevel(ip.ShrinkSize)
+			freeroot, skip := ip.indshrink(op, ip.blks[i], level, off)
+			if freeroot != 0 {
+				ip.freeIndex(op, i)
+			}
+			ip.ShrinkSize = ip.ShrinkSize - skip
+			if ip.ShrinkSize < newsz {
+				ip.ShrinkSize = newsz
 			}
 		}
 	}
 	ip.WriteInode(op)
 	return ip.IsShrinking()
 }
+
+// shrinkExtents is Shrink for an EXTENTS inode.  A step writes the inode
+// block and a node per level, and frees blocks in 2 bitmap blocks and a
+// node per level.
+func (ip *Inode) shrinkExtents(op *alloctxn.AllocTxn) bool {
+	for ip.IsShrinking() {
+		depth := ip.readExt(op, common.NULLBNUM).depth
+		if !ip.shrinkFits(op, 3+2*(depth+1)) {
+			break
+		}
+		ip.extShrink(op)
+	}
+	ip.WriteInode(op)
+	return ip.IsShrinking()
+}
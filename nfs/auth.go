@@ -0,0 +1,185 @@
+package nfs
+
+import (
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Permission checks, using the AUTH_UNIX credential of the caller and
+// the mode and owner in the inode.  A nil credential is the server
+// itself (e.g., a test calling the NFS handlers directly), which may
+// do anything.
+//
+
+const NOBODY uint32 = 65534 // uid and gid of callers without AUTH_UNIX
+
+const (
+	permRead  uint32 = 4
+	permWrite uint32 = 2
+	permExec  uint32 = 1
+
+	modeSticky uint32 = 01000
+	modeSetgid uint32 = 02000
+	modeSetuid uint32 = 04000
+)
+
+type Cred struct {
+	Uid  uint32
+	Gid  uint32
+	Gids []uint32
+}
+
+func MkCred(uid uint32, gid uint32, gids []uint32) *Cred {
+	return &Cred{Uid: uid, Gid: gid, Gids: gids}
+}
+
+// DecodeCred decodes the credential of an RPC call. Callers that don't
+// use AUTH_UNIX are nobody.
+func DecodeCred(auth rfc1057.Opaque_auth) (*Cred, bool) {
+	if auth.Flavor != rfc1057.AUTH_UNIX {
+		return MkCred(NOBODY, NOBODY, nil), true
+	}
+	var au rfc1057.Auth_unix
+	rd := xdr.MakeReader(auth.Body)
+	au.Xdr(rd)
+	if rd.Error() != nil {
+		return nil, false
+	}
+	return MkCred(au.Uid, au.Gid, au.Gids), true
+}
+
+func (cred *Cred) isRoot() bool {
+	return cred == nil || cred.Uid == 0
+}
+
+func (cred *Cred) isOwner(ip *inode.Inode) bool {
+	return cred.isRoot() || cred.Uid == ip.Uid
+}
+
+func (cred *Cred) inGroup(gid uint32) bool {
+	if cred.Gid == gid {
+		return true
+	}
+	for _, g := range cred.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// perm returns the rwx bits of ip's mode that apply to cred
+func (cred *Cred) perm(ip *inode.Inode) uint32 {
+	if cred.Uid == ip.Uid {
+		return (ip.Mode >> 6) & 7
+	}
+	if cred.inGroup(ip.Gid) {
+		return (ip.Mode >> 3) & 7
+	}
+	return ip.Mode & 7
+}
+
+// may reports if cred has all permissions in want on ip.  Root may do
+// anything, except execute a file that nobody may execute.
+func (cred *Cred) may(ip *inode.Inode, want uint32) bool {
+	if cred.isRoot() {
+		if want&permExec != 0 && ip.Kind != nfstypes.NF3DIR {
+			return ip.Mode&0111 != 0
+		}
+		return true
+	}
+	return cred.perm(ip)&want == want
+}
+
+// mayDelete reports if cred may remove ip from dip, which additionally
+// requires ownership of ip or dip if dip is sticky.
+func (cred *Cred) mayDelete(dip *inode.Inode, ip *inode.Inode) bool {
+	if !cred.may(dip, permWrite|permExec) {
+		return false
+	}
+	if dip.Mode&modeSticky != 0 {
+		return cred.isOwner(dip) || cred.isOwner(ip)
+	}
+	return true
+}
+
+// access computes the ACCESS3 bits in want that cred has on ip
+func (cred *Cred) access(ip *inode.Inode, want uint32) uint32 {
+	var access uint32 = 0
+	if cred.may(ip, permRead) {
+		access = access | nfstypes.ACCESS3_READ
+	}
+	if cred.may(ip, permWrite) {
+		access = access | nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND
+		if ip.Kind == nfstypes.NF3DIR {
+			access = access | nfstypes.ACCESS3_DELETE
+		}
+	}
+	if cred.may(ip, permExec) {
+		if ip.Kind == nfstypes.NF3DIR {
+			access = access | nfstypes.ACCESS3_LOOKUP
+		} else {
+			access = access | nfstypes.ACCESS3_EXECUTE
+		}
+	}
+	return access & want
+}
+
+// checkSetattr checks if cred may apply sattr to ip. Only root may
+// give away a file, and only the owner may change the mode, the group
+// (to one of its groups), or set times other than to now.
+func (cred *Cred) checkSetattr(ip *inode.Inode, sattr nfstypes.Sattr3) nfstypes.Nfsstat3 {
+	if cred.isRoot() {
+		return nfstypes.NFS3_OK
+	}
+	if sattr.Uid.Set_it && uint32(sattr.Uid.Uid) != ip.Uid {
+		return nfstypes.NFS3ERR_PERM
+	}
+	if sattr.Gid.Set_it && uint32(sattr.Gid.Gid) != ip.Gid &&
+		!(cred.isOwner(ip) && cred.inGroup(uint32(sattr.Gid.Gid))) {
+		return nfstypes.NFS3ERR_PERM
+	}
+	if sattr.Mode.Set_it && !cred.isOwner(ip) {
+		return nfstypes.NFS3ERR_PERM
+	}
+	if sattr.Atime.Set_it == nfstypes.SET_TO_CLIENT_TIME ||
+		sattr.Mtime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
+		if !cred.isOwner(ip) {
+			return nfstypes.NFS3ERR_PERM
+		}
+	}
+	if sattr.Atime.Set_it == nfstypes.SET_TO_SERVER_TIME ||
+		sattr.Mtime.Set_it == nfstypes.SET_TO_SERVER_TIME {
+		if !cred.isOwner(ip) && !cred.may(ip, permWrite) {
+			return nfstypes.NFS3ERR_ACCES
+		}
+	}
+	if sattr.Size.Set_it && !cred.may(ip, permWrite) {
+		return nfstypes.NFS3ERR_ACCES
+	}
+	return nfstypes.NFS3_OK
+}
+
+// own makes cred the owner of a new inode ip
+func (cred *Cred) own(ip *inode.Inode) {
+	if cred != nil {
+		ip.Uid = cred.Uid
+		ip.Gid = cred.Gid
+	}
+}
+
+// clearSetid drops setuid and setgid if a non-root caller changes the
+// owner or writes the file, as a local file system does, and returns
+// whether it changed ip.  The caller must write ip in the same
+// transaction.
+func (cred *Cred) clearSetid(ip *inode.Inode) bool {
+	if cred.isRoot() || ip.Mode&(modeSetuid|modeSetgid) == 0 {
+		return false
+	}
+	ip.Mode = ip.Mode & ^(modeSetuid | modeSetgid)
+	return true
+}
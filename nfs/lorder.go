@@ -13,29 +13,28 @@ import (
 )
 
 // Lock inodes in sorted order, but return the pointers in the same order as in inums
-// Caller must revalidate inodes.
+// An inum may appear more than once. Caller must revalidate inodes.
 func lockInodes(op *fstxn.FsTxn, inums []common.Inum) []*inode.Inode {
 	util.DPrintf(1, "lock inodes %v\n", inums)
 	sorted := make([]common.Inum, len(inums))
 	copy(sorted, inums)
-	sort.Slice(sorted, func(i, j int) bool { return inums[i] < inums[j] })
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
 	var inodes = make([]*inode.Inode, len(inums))
-	for _, inm := range sorted {
+	for i, inm := range sorted {
+		if i > 0 && sorted[i-1] == inm { // locked already
+			continue
+		}
 		ip := op.GetInodeInum(inm)
 		if ip == nil {
 			op.Abort()
 			return nil
 		}
-		// put in same position as in inums
-		pos := func(inm common.Inum) int {
-			for i, v := range inums {
-				if v == inm {
-					return i
-				}
+		// put in same position(s) as in inums
+		for j, v := range inums {
+			if v == inm {
+				inodes[j] = ip
 			}
-			panic("func")
-		}(inm)
-		inodes[pos] = ip
+		}
 	}
 	return inodes
 }
@@ -1,27 +1,46 @@
 package nfs
 
 import (
+	"encoding/binary"
+	"sync"
+
 	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/obj"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
 	"github.com/mit-pdos/go-nfsd/shrinker"
 	"github.com/mit-pdos/go-nfsd/super"
 	"github.com/mit-pdos/go-nfsd/util/stats"
 )
 
+// Nfs is a handle on the server's state, bound to the credential of
+// the caller, which NFS handlers check permissions against
 type Nfs struct {
+	*nfsState
+	// caller of the RPC, if bound with WithCred
+	cred *Cred
+}
+
+type nfsState struct {
 	fsstate  *fstxn.FsState
 	shrinkst *shrinker.ShrinkerSt
 	// support unstable writes
 	Unstable bool
 	// statistics
-	stats [NUM_NFS_OPS]stats.Op
+	stats *[NUM_NFS_OPS]stats.Op
+	// write verifier, which changes on every boot
+	verf nfstypes.Writeverf3
+	// serializes renames between directories, which may move a
+	// directory to a new parent
+	renameMu *sync.Mutex
 }
 
 func MakeNfs(d disk.Disk) *Nfs {
@@ -32,25 +51,96 @@ func MakeNfs(d disk.Disk) *Nfs {
 		d.Size(),
 		super.NBlockBitmap, super.NInodeBitmap, super.Maxaddr)
 
+	ours, done := super.Format()
+	if !ours && !super.Blank() {
+		panic("MakeNfs: disk holds a file system of another format")
+	}
+	freed := alloctxn.MkFreed(d)
 	log := obj.MkLog(d) // runs recovery
 
-	i := readRootInode(super)
-	if i.Kind == 0 { // make a new file system?
-		makeFs(super)
+	// mkfs redoes the steps that a crash during an earlier mkfs didn't
+	// finish
+	mkfs := !done
+	var rootDir = false
+	if mkfs {
+		super.WriteFormat(false)
+		rootDir = hasRootDir(super, log)
+		if !rootDir {
+			makeFs(super)
+		}
 	}
 
-	st := fstxn.MkFsState(super, log)
+	st := fstxn.MkFsState(super, log, freed)
 	nfs := &Nfs{
-		fsstate:  st,
-		shrinkst: shrinker.MkShrinkerSt(st),
-		Unstable: true,
+		nfsState: &nfsState{
+			fsstate:  st,
+			shrinkst: shrinker.MkShrinkerSt(st),
+			Unstable: true,
+			stats:    new([NUM_NFS_OPS]stats.Op),
+			renameMu: new(sync.Mutex),
+		},
+		cred: nil,
 	}
-	if i.Kind == 0 {
-		nfs.makeRootDir()
+	if mkfs {
+		if !rootDir {
+			nfs.makeRootDir()
+		}
+		super.WriteFormat(true)
 	}
+	nfs.verf = nfs.boot()
+	nfs.scavenge()
 	return nfs
 }
 
+// scavenge reclaims the space of the inodes that a crash left
+// shrinking, before the server handles requests
+func (nfs *Nfs) scavenge() {
+	n, nblk := nfs.shrinkst.Scavenge()
+	if n > 0 {
+		util.DPrintf(0, "Scavenge: reclaimed %d blocks of %d inodes\n", nblk, n)
+	}
+}
+
+// SetBlockMap selects whether new files map their blocks with block
+// pointers in the inode, instead of with an extent tree
+func (nfs *Nfs) SetBlockMap(blockmap bool) {
+	nfs.fsstate.Super.BlockMap = blockmap
+}
+
+// SetBypass selects whether full-block writes to new blocks of a file
+// go directly to disk instead of through the log, like ext4's
+// data=ordered; the journal still orders them before the metadata that
+// points to them.  Call it before the server handles requests.
+func (nfs *Nfs) SetBypass(bypass bool) {
+	nfs.fsstate.Super.Bypass = bypass
+}
+
+// boot increments the boot counter in the reserved block, and returns
+// it as the write verifier for this boot. Clients resend unstable
+// writes if the verifier changed, because the crash or shutdown may
+// have lost them.
+func (nfs *Nfs) boot() nfstypes.Writeverf3 {
+	op := fstxn.Begin(nfs.fsstate)
+	a := nfs.fsstate.Super.BootAddr()
+	b := op.Atxn.Op.ReadBuf(a, 64)
+	n := marshal.NewDec(b.Data).GetInt() + 1
+	enc := marshal.NewEnc(8)
+	enc.PutInt(n)
+	op.Atxn.Op.OverWrite(a, 64, enc.Finish())
+	if !op.Commit() {
+		panic("boot")
+	}
+	var verf nfstypes.Writeverf3
+	binary.BigEndian.PutUint64(verf[:], n)
+	return verf
+}
+
+// WithCred returns a handle on nfs's state whose NFS handlers check
+// permissions on behalf of cred.
+func (nfs *Nfs) WithCred(cred *Cred) *Nfs {
+	return &Nfs{nfsState: nfs.nfsState, cred: cred}
+}
+
 func (nfs *Nfs) ShutdownNfs() {
 	util.DPrintf(1, "Shutdown\n")
 	nfs.shrinkst.Shutdown()
@@ -79,17 +169,25 @@ func (nfs *Nfs) makeRootDir() {
 }
 
 // Make an empty file system
-func makeFs(super *super.FsSuper) {
+// hasRootDir returns whether mkfs made the root directory, which it
+// does last, in one transaction
+func hasRootDir(fs *super.FsSuper, log *obj.Log) bool {
+	b := log.Load(fs.Inum2Addr(common.ROOTINUM), super.INODESZ*8)
+	ip := inode.Decode(b, common.ROOTINUM)
+	return ip.Kind == nfstypes.NF3DIR && ip.Nlink > 1
+}
+
+func makeFs(fs *super.FsSuper) {
 	util.DPrintf(1, "mkfs")
 
 	root := inode.MkRootInode()
 	util.DPrintf(1, "root %v\n", root)
-	raddr := super.Inum2Addr(common.ROOTINUM)
+	raddr := fs.Inum2Addr(common.ROOTINUM)
 	rootblk := root.Encode()
-	rootbuf := buf.MkBuf(raddr, common.INODESZ*8, rootblk)
-	rootbuf.WriteDirect(super.Disk)
+	rootbuf := buf.MkBuf(raddr, super.INODESZ*8, rootblk)
+	rootbuf.WriteDirect(fs.Disk)
 
-	markAlloc(super, super.DataStart(), super.MaxBnum())
+	markAlloc(fs, fs.DataStart(), fs.MaxBnum())
 }
 
 func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
@@ -126,11 +224,3 @@ func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
 	blk2[0] = blk2[0] | 1<<1
 	super.Disk.Write(uint64(super.BitmapInodeStart()), blk2)
 }
-
-func readRootInode(super *super.FsSuper) *inode.Inode {
-	addr := super.Inum2Addr(common.ROOTINUM)
-	blk := super.Disk.Read(uint64(addr.Blkno))
-	buf := buf.MkBufLoad(addr, common.INODESZ*8, blk)
-	i := inode.Decode(buf, common.ROOTINUM)
-	return i
-}
@@ -28,8 +28,16 @@ func (clnt *NfsClient) Crash() {
 }
 
 func (clnt *NfsClient) CreateOp(fh nfstypes.Nfs_fh3, name string) nfstypes.CREATE3res {
+	return clnt.CreateAttrOp(fh, name, nfstypes.Sattr3{})
+}
+
+func (clnt *NfsClient) CreateAttrOp(fh nfstypes.Nfs_fh3, name string, sattr nfstypes.Sattr3) nfstypes.CREATE3res {
+	how := nfstypes.Createhow3{Obj_attributes: sattr}
+	return clnt.CreateHowOp(fh, name, how)
+}
+
+func (clnt *NfsClient) CreateHowOp(fh nfstypes.Nfs_fh3, name string, how nfstypes.Createhow3) nfstypes.CREATE3res {
 	where := nfstypes.Diropargs3{Dir: fh, Name: nfstypes.Filename3(name)}
-	how := nfstypes.Createhow3{}
 	args := nfstypes.CREATE3args{Where: where, How: how}
 	attr := clnt.srv.NFSPROC3_CREATE(args)
 	return attr
@@ -48,6 +56,17 @@ func (clnt *NfsClient) GetattrOp(fh nfstypes.Nfs_fh3) *nfstypes.GETATTR3res {
 	return &attr
 }
 
+func (clnt *NfsClient) AccessOp(fh nfstypes.Nfs_fh3, access uint32) *nfstypes.ACCESS3res {
+	args := nfstypes.ACCESS3args{Object: fh, Access: nfstypes.Uint32(access)}
+	reply := clnt.srv.NFSPROC3_ACCESS(args)
+	return &reply
+}
+
+// AsUser returns a client that calls the server with cred
+func (clnt *NfsClient) AsUser(cred *Cred) *NfsClient {
+	return &NfsClient{srv: clnt.srv.WithCred(cred)}
+}
+
 func (clnt *NfsClient) WriteOp(fh nfstypes.Nfs_fh3, off uint64, data []byte, how nfstypes.Stable_how) *nfstypes.WRITE3res {
 	args := nfstypes.WRITE3args{
 		File:   fh,
@@ -101,6 +120,15 @@ func (clnt *NfsClient) SymLinkOp(dir nfstypes.Nfs_fh3, name string, path nfstype
 	return attr
 }
 
+func (clnt *NfsClient) MknodOp(dir nfstypes.Nfs_fh3, name string, kind nfstypes.Ftype3, spec nfstypes.Specdata3) nfstypes.MKNOD3res {
+	where := nfstypes.Diropargs3{Dir: dir, Name: nfstypes.Filename3(name)}
+	what := nfstypes.Mknoddata3{Ftype: kind}
+	what.Device.Spec = spec
+	args := nfstypes.MKNOD3args{Where: where, What: what}
+	attr := clnt.srv.NFSPROC3_MKNOD(args)
+	return attr
+}
+
 func (clnt *NfsClient) ReadLinkOp(fh nfstypes.Nfs_fh3) nfstypes.READLINK3res {
 	args := nfstypes.READLINK3args{Symlink: fh}
 	attr := clnt.srv.NFSPROC3_READLINK(args)
@@ -108,9 +136,13 @@ func (clnt *NfsClient) ReadLinkOp(fh nfstypes.Nfs_fh3) nfstypes.READLINK3res {
 }
 
 func (clnt *NfsClient) CommitOp(fh nfstypes.Nfs_fh3, cnt uint64) *nfstypes.COMMIT3res {
+	return clnt.CommitRangeOp(fh, 0, cnt)
+}
+
+func (clnt *NfsClient) CommitRangeOp(fh nfstypes.Nfs_fh3, off uint64, cnt uint64) *nfstypes.COMMIT3res {
 	args := nfstypes.COMMIT3args{
 		File:   fh,
-		Offset: nfstypes.Offset3(0),
+		Offset: nfstypes.Offset3(off),
 		Count:  nfstypes.Count3(cnt)}
 	reply := clnt.srv.NFSPROC3_COMMIT(args)
 	return &reply
@@ -126,16 +158,51 @@ func (clnt *NfsClient) RenameOp(fhfrom nfstypes.Nfs_fh3, from string,
 	return reply.Status
 }
 
+func (clnt *NfsClient) LinkOp(fh nfstypes.Nfs_fh3, dir nfstypes.Nfs_fh3, name string) nfstypes.LINK3res {
+	args := nfstypes.LINK3args{
+		File: fh,
+		Link: nfstypes.Diropargs3{Dir: dir, Name: nfstypes.Filename3(name)},
+	}
+	reply := clnt.srv.NFSPROC3_LINK(args)
+	return reply
+}
+
 func (clnt *NfsClient) SetattrOp(fh nfstypes.Nfs_fh3, sz uint64) nfstypes.SETATTR3res {
 	size := nfstypes.Set_size3{Set_it: true, Size: nfstypes.Size3(sz)}
 	attr := nfstypes.Sattr3{Size: size}
-	args := nfstypes.SETATTR3args{Object: fh, New_attributes: attr}
+	return clnt.SetattrAttrOp(fh, attr)
+}
+
+func (clnt *NfsClient) SetattrAttrOp(fh nfstypes.Nfs_fh3, sattr nfstypes.Sattr3) nfstypes.SETATTR3res {
+	args := nfstypes.SETATTR3args{Object: fh, New_attributes: sattr}
 	reply := clnt.srv.NFSPROC3_SETATTR(args)
 	return reply
 }
 
-func (clnt *NfsClient) ReadDirPlusOp(dir nfstypes.Nfs_fh3, cnt uint64) nfstypes.READDIRPLUS3res {
-	args := nfstypes.READDIRPLUS3args{Dir: dir, Dircount: nfstypes.Count3(100), Maxcount: nfstypes.Count3(cnt)}
+func (clnt *NfsClient) FsstatOp(fh nfstypes.Nfs_fh3) nfstypes.FSSTAT3res {
+	args := nfstypes.FSSTAT3args{Fsroot: fh}
+	reply := clnt.srv.NFSPROC3_FSSTAT(args)
+	return reply
+}
+
+func (clnt *NfsClient) PathconfOp(fh nfstypes.Nfs_fh3) nfstypes.PATHCONF3res {
+	args := nfstypes.PATHCONF3args{Object: fh}
+	reply := clnt.srv.NFSPROC3_PATHCONF(args)
+	return reply
+}
+
+func (clnt *NfsClient) ReadDirOp(dir nfstypes.Nfs_fh3, cookie nfstypes.Cookie3,
+	verf nfstypes.Cookieverf3, cnt uint64) nfstypes.READDIR3res {
+	args := nfstypes.READDIR3args{Dir: dir, Cookie: cookie, Cookieverf: verf,
+		Count: nfstypes.Count3(cnt)}
+	reply := clnt.srv.NFSPROC3_READDIR(args)
+	return reply
+}
+
+func (clnt *NfsClient) ReadDirPlusOp(dir nfstypes.Nfs_fh3, cookie nfstypes.Cookie3,
+	verf nfstypes.Cookieverf3, cnt uint64) nfstypes.READDIRPLUS3res {
+	args := nfstypes.READDIRPLUS3args{Dir: dir, Cookie: cookie, Cookieverf: verf,
+		Dircount: nfstypes.Count3(100), Maxcount: nfstypes.Count3(cnt)}
 	reply := clnt.srv.NFSPROC3_READDIRPLUS(args)
 	return reply
 }
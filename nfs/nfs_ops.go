@@ -1,6 +1,7 @@
 package nfs
 
 import (
+	"encoding/binary"
 	"time"
 
 	"github.com/mit-pdos/go-journal/common"
@@ -11,6 +12,7 @@ import (
 	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/tchajed/goose/machine/disk"
 )
 
 //
@@ -23,10 +25,20 @@ import (
 // lock order).
 //
 
+const (
+	// largest WRITE, which may be larger than the log
+	WTMAX uint64 = 4 * 1024 * 1024
+	// bytes of a WRITE applied per transaction, which leaves room in
+	// the log for the metadata the chunk modifies
+	WRITECHUNK uint64 = jrnl.LogBytes / 2 / disk.BlockSize * disk.BlockSize
+)
+
 func errRet(op *fstxn.FsTxn, status *nfstypes.Nfsstat3, err nfstypes.Nfsstat3) {
 	*status = err
 	util.DPrintf(2, "errRet %v", err)
-	op.Abort()
+	if op != nil {
+		op.Abort()
+	}
 }
 
 func commitReply(op *fstxn.FsTxn, status *nfstypes.Nfsstat3) {
@@ -38,6 +50,31 @@ func commitReply(op *fstxn.FsTxn, status *nfstypes.Nfsstat3) {
 	}
 }
 
+// preOp returns the attributes of ip that wcc data reports from before
+// an operation; the caller must hold ip's lock and not have modified
+// ip yet.
+func preOp(ip *inode.Inode) nfstypes.Pre_op_attr {
+	return nfstypes.Pre_op_attr{
+		Attributes_follow: true,
+		Attributes: nfstypes.Wcc_attr{
+			Size:  nfstypes.Size3(ip.Size),
+			Mtime: ip.Mtime,
+			Ctime: ip.Ctime,
+		},
+	}
+}
+
+func postOp(ip *inode.Inode) nfstypes.Post_op_attr {
+	return nfstypes.Post_op_attr{
+		Attributes_follow: true,
+		Attributes:        ip.MkFattr(),
+	}
+}
+
+func mkWcc(pre nfstypes.Pre_op_attr, ip *inode.Inode) nfstypes.Wcc_data {
+	return nfstypes.Wcc_data{Before: pre, After: postOp(ip)}
+}
+
 func (nfs *Nfs) NFSPROC3_NULL() {
 	util.DPrintf(1, "NFS Null\n")
 }
@@ -98,52 +135,24 @@ func (nfs *Nfs) NFSPROC3_SETATTR(args nfstypes.SETATTR3args) nfstypes.SETATTR3re
 		return reply
 
 	}
-	if args.New_attributes.Mode.Set_it {
-		util.DPrintf(1, "NFS SetAttr ignore mode %v\n", args)
-		err = nfstypes.NFS3_OK
-	}
-	if args.New_attributes.Uid.Set_it {
-		util.DPrintf(1, "NFS SetAttr uid not supported %v\n", args)
-	}
-	if args.New_attributes.Gid.Set_it {
-		util.DPrintf(1, "NFS SetAttr gid not supported %v\n", args)
+	err = nfs.cred.checkSetattr(ip, args.New_attributes)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &reply.Status, err)
+		return reply
 	}
+	pre := preOp(ip)
 	if args.New_attributes.Size.Set_it {
 		shrink := ip.Resize(op.Atxn, uint64(args.New_attributes.Size.Size))
 		if shrink {
 			nfs.shrinkst.StartShrinker(ip.Inum)
 		}
-		err = nfstypes.NFS3_OK
-	}
-	if args.New_attributes.Atime.Set_it != nfstypes.DONT_CHANGE {
-		util.DPrintf(1, "NFS SetAttr Atime %v\n", args)
-		if args.New_attributes.Atime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
-			ip.Atime = args.New_attributes.Atime.Atime
-		} else {
-			ip.Atime = inode.NfstimeNow()
-
-		}
-		ip.WriteInode(op.Atxn)
-		err = nfstypes.NFS3_OK
-	}
-	if args.New_attributes.Mtime.Set_it != nfstypes.DONT_CHANGE {
-		util.DPrintf(1, "NFS SetAttr Mtime %v\n", args)
-		if args.New_attributes.Mtime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
-			ip.Mtime = args.New_attributes.Mtime.Mtime
-		} else {
-			ip.Mtime = inode.NfstimeNow()
-
-		}
-		ip.WriteInode(op.Atxn)
-		err = nfstypes.NFS3_OK
 	}
-	if err == nfstypes.NFS3_OK {
-		reply.Resok.Obj_wcc.After.Attributes_follow = true
-		reply.Resok.Obj_wcc.After.Attributes = ip.MkFattr()
-		commitReply(op, &reply.Status)
-	} else {
-		errRet(op, &reply.Status, err)
+	if args.New_attributes.Uid.Set_it || args.New_attributes.Gid.Set_it {
+		nfs.cred.clearSetid(ip)
 	}
+	ip.SetAttr(op.Atxn, args.New_attributes)
+	reply.Resok.Obj_wcc = mkWcc(pre, ip)
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -156,7 +165,7 @@ func twoInodes(ino1, ino2 *inode.Inode) []*inode.Inode {
 
 // Lock the inode for dfh and the inode for name.  name may be a
 // directory (e.g., "."). We must lock directories in ascending inum
-// order.
+// order.  The caller must have search permission on dfh.
 func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (*fstxn.FsTxn, []*inode.Inode, nfstypes.Nfsstat3) {
 	var err nfstypes.Nfsstat3 = nfstypes.NFS3_OK
 	var inodes []*inode.Inode
@@ -173,6 +182,12 @@ func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (
 			break
 		}
 		inodes = []*inode.Inode{dip}
+		// check before looking up name, so that a caller who may
+		// not search dip can't tell whether name exists
+		if dip.Kind == nfstypes.NF3DIR && !nfs.cred.may(dip, permExec) {
+			err = nfstypes.NFS3ERR_ACCES
+			break
+		}
 		inum, _ := dir.LookupName(dip, op, name)
 		if inum == common.NULLINUM {
 			util.DPrintf(1, "getInodesLocked noent\n")
@@ -208,16 +223,23 @@ func (nfs *Nfs) NFSPROC3_LOOKUP(args nfstypes.LOOKUP3args) nfstypes.LOOKUP3res {
 	var reply nfstypes.LOOKUP3res
 
 	util.DPrintf(1, "NFS Lookup %v\n", args)
+	if dir.NameTooLong(args.What.Name) {
+		reply.Status = nfstypes.NFS3ERR_NAMETOOLONG
+		return reply
+	}
 	op, inodes, err := nfs.getInodesLocked(args.What.Dir, args.What.Name)
 	if err != nfstypes.NFS3_OK {
+		if err == nfstypes.NFS3ERR_NOENT {
+			reply.Resfail.Dir_attributes = postOp(inodes[0])
+		}
 		errRet(op, &reply.Status, err)
 		return reply
 	}
 	i := inodes[0]
 	fh := fh.Fh{Ino: i.Inum, Gen: i.Gen}
 	reply.Resok.Object = fh.MakeFh3()
-	reply.Resok.Obj_attributes.Attributes_follow = true
-	reply.Resok.Obj_attributes.Attributes = i.MkFattr()
+	reply.Resok.Obj_attributes = postOp(i)
+	reply.Resok.Dir_attributes = postOp(inodes[len(inodes)-1])
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -226,38 +248,51 @@ func (nfs *Nfs) NFSPROC3_ACCESS(args nfstypes.ACCESS3args) nfstypes.ACCESS3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_ACCESS, time.Now())
 	var reply nfstypes.ACCESS3res
 	util.DPrintf(1, "NFS Access %v\n", args)
-	reply.Status = nfstypes.NFS3_OK
-	reply.Resok.Access = nfstypes.Uint32(nfstypes.ACCESS3_READ | nfstypes.ACCESS3_LOOKUP | nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND | nfstypes.ACCESS3_DELETE | nfstypes.ACCESS3_EXECUTE)
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Object)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	reply.Resok.Access = nfstypes.Uint32(nfs.cred.access(ip, uint32(args.Access)))
+	reply.Resok.Obj_attributes = postOp(ip)
+	commitReply(op, &reply.Status)
 	return reply
 }
 
-func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count uint64) (*fstxn.FsTxn, []byte, bool, nfstypes.Nfsstat3) {
+func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count uint64) (*fstxn.FsTxn, *inode.Inode, []byte, bool, nfstypes.Nfsstat3) {
 	var readCount = count
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(fh)
 	if ip == nil {
-		return op, nil, false, nfstypes.NFS3ERR_STALE
+		return op, nil, nil, false, nfstypes.NFS3ERR_STALE
 	}
 	if ip.Kind != kind {
-		return op, nil, false, nfstypes.NFS3ERR_INVAL
+		return op, nil, nil, false, nfstypes.NFS3ERR_INVAL
+	}
+	// reading to execute needs only execute permission
+	if ip.Kind == nfstypes.NF3REG && !nfs.cred.may(ip, permRead) &&
+		!nfs.cred.may(ip, permExec) {
+		return op, nil, nil, false, nfstypes.NFS3ERR_ACCES
 	}
 	if ip.Kind == nfstypes.NF3LNK {
 		readCount = ip.Size
 	}
 	data, eof := ip.Read(op.Atxn, offset, readCount)
-	return op, data, eof, nfstypes.NFS3_OK
+	return op, ip, data, eof, nfstypes.NFS3_OK
 }
 
 func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_READ, time.Now())
 	var reply nfstypes.READ3res
 	util.DPrintf(1, "NFS Read %v %d %d\n", args.File, args.Offset, args.Count)
-	op, data, eof, err := nfs.doRead(args.File, nfstypes.NF3REG,
+	op, ip, data, eof, err := nfs.doRead(args.File, nfstypes.NF3REG,
 		uint64(args.Offset), uint64(args.Count))
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 	}
+	reply.Resok.File_attributes = postOp(ip)
 	reply.Resok.Count = nfstypes.Count3(len(data))
 	reply.Resok.Data = data
 	reply.Resok.Eof = eof
@@ -265,75 +300,125 @@ func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	return reply
 }
 
-// XXX Mtime
+// getWrite looks up fh for a write, checking that the caller may write
+// it.
+func (nfs *Nfs) getWrite(fh nfstypes.Nfs_fh3) (*fstxn.FsTxn, *inode.Inode, nfstypes.Nfsstat3) {
+	op, ip, err := nfs.getShrink(fh)
+	if err != nfstypes.NFS3_OK {
+		return op, ip, err
+	}
+	if ip.Kind != nfstypes.NF3REG {
+		return op, ip, nfstypes.NFS3ERR_INVAL
+	}
+	if !nfs.cred.may(ip, permWrite) {
+		return op, ip, nfstypes.NFS3ERR_ACCES
+	}
+	return op, ip, nfstypes.NFS3_OK
+}
+
+// commitWrite commits op, which wrote cnt bytes at off of inum, at the
+// level stable asks for
+func commitWrite(op *fstxn.FsTxn, inum common.Inum, off uint64, cnt uint64,
+	stable nfstypes.Stable_how) bool {
+	if stable == nfstypes.FILE_SYNC {
+		// RFC: "FILE_SYNC, the server must commit the
+		// data written plus all file system metadata
+		// to stable storage before returning results."
+		return op.Commit()
+	} else if stable == nfstypes.DATA_SYNC {
+		// RFC: "DATA_SYNC, then the server must commit
+		// all of the data to stable storage and
+		// enough of the metadata to retrieve the data
+		// before returning."
+		return op.CommitData()
+	}
+	// RFC:	"UNSTABLE, the server is free to commit
+	// any part of the data and the metadata to
+	// stable storage, including all or none,
+	// before returning a reply to the
+	// client. There is no guarantee whether or
+	// when any uncommitted data will subsequently
+	// be committed to stable storage. The only
+	// guarantees made by the server are that it
+	// will not destroy any data without changing
+	// the value of verf and that it will not
+	// commit the data and metadata at a level
+	// less than that requested by the client."
+	return op.CommitUnstable(inum, off, cnt)
+}
+
+// NFSPROC3_WRITE applies a write in chunks of at most WRITECHUNK
+// bytes, each in its own transaction, so that a write can be larger
+// than the log.  If a later chunk fails, the reply reports the bytes
+// of the chunks before it, which are committed at the requested level;
+// the client resends the rest.  Other operations may change the file
+// between chunks, so a write of several chunks has no pre-op
+// attributes that its post-op attributes follow from.
 func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_WRITE, time.Now())
 	var reply nfstypes.WRITE3res
-	var ok = true
 
 	util.DPrintf(1, "NFS Write %v off %d cnt %d how %d\n", args.File, args.Offset,
 		args.Count, args.Stable)
 
-	op, ip, err := nfs.getShrink(args.File)
+	op, ip, err := nfs.getWrite(args.File)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
-
 	}
-	if ip.Kind != nfstypes.NF3REG {
+	count := uint64(args.Count)
+	if count > WTMAX || uint64(len(args.Data)) < count {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
-	if uint64(args.Count) >= jrnl.LogBytes {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-		return reply
-	}
-	count, writeOk := ip.Write(op.Atxn, uint64(args.Offset), uint64(args.Count),
-		args.Data)
-	if !writeOk {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
-		return reply
-	}
 	// if not supporting unstable writes, upgrade stability
 	if args.Stable == nfstypes.UNSTABLE && !nfs.Unstable {
 		args.Stable = nfstypes.FILE_SYNC
 	}
-	if args.Stable == nfstypes.FILE_SYNC {
-		// RFC: "FILE_SYNC, the server must commit the
-		// data written plus all file system metadata
-		// to stable storage before returning results."
-		ok = op.Commit()
-	} else if args.Stable == nfstypes.DATA_SYNC {
-		// RFC: "DATA_SYNC, then the server must commit
-		// all of the data to stable storage and
-		// enough of the metadata to retrieve the data
-		// before returning."
-		ok = op.CommitData()
-	} else {
-		// RFC:	"UNSTABLE, the server is free to commit
-		// any part of the data and the metadata to
-		// stable storage, including all or none,
-		// before returning a reply to the
-		// client. There is no guarantee whether or
-		// when any uncommitted data will subsequently
-		// be committed to stable storage. The only
-		// guarantees made by the server are that it
-		// will not destroy any data without changing
-		// the value of verf and that it will not
-		// commit the data and metadata at a level
-		// less than that requested by the client."
-		ok = op.CommitUnstable()
-	}
-	if ok {
-		reply.Status = nfstypes.NFS3_OK
-		reply.Resok.Count = nfstypes.Count3(count)
-		reply.Resok.Committed = args.Stable
-		reply.Resok.File_wcc.After.Attributes_follow = true
-		reply.Resok.File_wcc.After.Attributes = ip.MkFattr()
-	} else {
-		util.DPrintf(1, "Write transaction failed")
-		reply.Status = nfstypes.NFS3ERR_SERVERFAULT
+	pre := preOp(ip)
+	var wcc nfstypes.Wcc_data
+	var done uint64 = 0
+	for {
+		off := uint64(args.Offset) + done
+		// end chunks at block boundaries
+		n := util.Min(count-done, WRITECHUNK-off%disk.BlockSize)
+		cnt, writeOk := ip.Write(op.Atxn, off, n, args.Data[done:done+n])
+		if !writeOk {
+			if done == 0 {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
+				return reply
+			}
+			op.Abort()
+			break
+		}
+		if cnt > 0 && nfs.cred.clearSetid(ip) {
+			ip.WriteInode(op.Atxn)
+		}
+		wcc = mkWcc(pre, ip)
+		if !commitWrite(op, ip.Inum, off, cnt, args.Stable) {
+			if done == 0 {
+				util.DPrintf(1, "Write transaction failed")
+				reply.Status = nfstypes.NFS3ERR_SERVERFAULT
+				return reply
+			}
+			break
+		}
+		done += cnt
+		if cnt < n || done == count {
+			break
+		}
+		op, ip, err = nfs.getWrite(args.File)
+		if err != nfstypes.NFS3_OK {
+			op.Abort()
+			break
+		}
+		pre = nfstypes.Pre_op_attr{Attributes_follow: false}
 	}
+	reply.Status = nfstypes.NFS3_OK
+	reply.Resok.Count = nfstypes.Count3(done)
+	reply.Resok.Committed = args.Stable
+	reply.Resok.File_wcc = wcc
+	reply.Resok.Verf = nfs.verf
 	return reply
 }
 
@@ -343,12 +428,19 @@ func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Fi
 	var ip *inode.Inode
 	var dip *inode.Inode
 	var err = nfstypes.NFS3_OK
+	if dir.NameTooLong(name) {
+		return op, nil, nil, nfstypes.NFS3ERR_NAMETOOLONG
+	}
 	for {
 		dip = op.GetInodeFh(dfh)
 		if dip == nil {
 			err = nfstypes.NFS3ERR_STALE
 			break
 		}
+		if !nfs.cred.may(dip, permWrite|permExec) {
+			err = nfstypes.NFS3ERR_ACCES
+			break
+		}
 		inum, _ := dir.LookupName(dip, op, name)
 		if inum != common.NULLINUM {
 			err = nfstypes.NFS3ERR_EXIST
@@ -387,8 +479,17 @@ func (nfs *Nfs) doDecLink(op *fstxn.FsTxn, ip *inode.Inode) {
 	}
 }
 
+// doDecLinkDir drops the links of directory ip, whose entry in dip
+// is being removed: the entry itself, ip's ".", and the link that ip's
+// ".." adds to dip.
+func (nfs *Nfs) doDecLinkDir(op *fstxn.FsTxn, dip *inode.Inode, ip *inode.Inode) {
+	ip.DecLink(op.Atxn)
+	dip.DecLink(op.Atxn)
+	nfs.doDecLink(op, ip)
+}
+
 func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfstypes.Ftype3,
-	data []byte) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3) {
+	sattr nfstypes.Sattr3, data []byte, rdev nfstypes.Specdata3) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3, dirwcc nfstypes.Wcc_data) {
 	beginOp := fstxn.Begin(nfs.fsstate)
 	var dip, ip *inode.Inode
 	op, dip, ip, err = nfs.getAlloc(beginOp, dfh, name, kind)
@@ -399,15 +500,28 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 		err = nfstypes.NFS3ERR_NOSPC
 		return
 	}
+	pre := preOp(dip)
+	nfs.cred.own(ip)
+	err = nfs.cred.checkSetattr(ip, sattr)
+	if err != nfstypes.NFS3_OK {
+		nfs.doDecLink(op, ip)
+		return
+	}
+	ip.Rdev = rdev
+	ip.SetAttr(op.Atxn, sattr)
 	if kind == nfstypes.NF3DIR {
+		if !dip.IncLink(op.Atxn) { // for ..
+			nfs.doDecLink(op, ip)
+			err = nfstypes.NFS3ERR_MLINK
+			return
+		}
 		ok := dir.InitDir(ip, op, dip.Inum)
 		if !ok {
+			dip.DecLink(op.Atxn)
 			nfs.doDecLink(op, ip)
 			err = nfstypes.NFS3ERR_NOSPC
 			return
 		}
-		dip.Nlink = dip.Nlink + 1 // for ..
-		dip.WriteInode(op.Atxn)
 	}
 	if kind == nfstypes.NF3LNK {
 		_, ok := ip.Write(op.Atxn, uint64(0), uint64(len(data)), data)
@@ -419,26 +533,113 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 	}
 	ok := dir.AddName(dip, op, ip.Inum, name)
 	if !ok {
-		nfs.doDecLink(op, ip)
-		err = nfstypes.NFS3ERR_IO
+		if kind == nfstypes.NF3DIR {
+			nfs.doDecLinkDir(op, dip, ip)
+		} else {
+			nfs.doDecLink(op, ip)
+		}
+		err = nfstypes.NFS3ERR_NOSPC
 		return
 	}
 	err = nfstypes.NFS3_OK
 	fh3 = fh.Fh{Ino: ip.Inum, Gen: ip.Gen}.MakeFh3()
 	fattr = ip.MkFattr()
+	dirwcc = mkWcc(pre, dip)
 	return
 }
 
+// createVerf returns the attributes in which an EXCLUSIVE create
+// stores verf. As RFC 1813 suggests, they are the new file's atime and
+// mtime, which the client sets with SETATTR once the create succeeded.
+func createVerf(verf nfstypes.Createverf3) nfstypes.Sattr3 {
+	var sattr nfstypes.Sattr3
+	sattr.Atime.Set_it = nfstypes.SET_TO_CLIENT_TIME
+	sattr.Atime.Atime.Seconds = nfstypes.Uint32(binary.BigEndian.Uint32(verf[0:4]))
+	sattr.Mtime.Set_it = nfstypes.SET_TO_CLIENT_TIME
+	sattr.Mtime.Mtime.Seconds = nfstypes.Uint32(binary.BigEndian.Uint32(verf[4:8]))
+	return sattr
+}
+
+// createExisting handles an UNCHECKED or EXCLUSIVE create of a name
+// that exists.  An EXCLUSIVE create succeeds if it is a retry of the
+// create that made the file.  An UNCHECKED create succeeds on a
+// regular file, and only applies the size in its attributes, like a
+// local open with O_CREAT|O_TRUNC.  Returns NFS3ERR_NOENT if the name
+// disappeared.
+func (nfs *Nfs) createExisting(args nfstypes.CREATE3args) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3, dirwcc nfstypes.Wcc_data) {
+	for {
+		var inodes []*inode.Inode
+		op, inodes, err = nfs.getInodesLocked(args.Where.Dir, args.Where.Name)
+		if err != nfstypes.NFS3_OK {
+			return
+		}
+		ip := inodes[0]
+		if ip.Kind != nfstypes.NF3REG {
+			err = nfstypes.NFS3ERR_EXIST
+			return
+		}
+		if args.How.Mode == nfstypes.EXCLUSIVE {
+			verf := createVerf(args.How.Verf)
+			if ip.Atime != verf.Atime.Atime || ip.Mtime != verf.Mtime.Mtime {
+				err = nfstypes.NFS3ERR_EXIST
+				return
+			}
+		} else if args.How.Obj_attributes.Size.Set_it {
+			size := nfstypes.Sattr3{Size: args.How.Obj_attributes.Size}
+			err = nfs.cred.checkSetattr(ip, size)
+			if err != nfstypes.NFS3_OK {
+				return
+			}
+			if ip.IsShrinking() {
+				inum := ip.Inum
+				op.Abort()
+				if !nfs.shrinkst.DoShrink(inum) {
+					op = fstxn.Begin(nfs.fsstate)
+					err = nfstypes.NFS3ERR_SERVERFAULT
+					return
+				}
+				continue
+			}
+			if ip.Resize(op.Atxn, uint64(size.Size.Size)) {
+				nfs.shrinkst.StartShrinker(ip.Inum)
+			}
+			nfs.cred.clearSetid(ip)
+			ip.SetAttr(op.Atxn, size)
+		}
+		fh3 = fh.Fh{Ino: ip.Inum, Gen: ip.Gen}.MakeFh3()
+		fattr = ip.MkFattr()
+		dip := inodes[1] // the directory didn't change
+		dirwcc = mkWcc(preOp(dip), dip)
+		return
+	}
+}
+
 func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_CREATE, time.Now())
 	var reply nfstypes.CREATE3res
+	var op *fstxn.FsTxn
+	var err nfstypes.Nfsstat3
+	var fh3 nfstypes.Nfs_fh3
+	var fattr nfstypes.Fattr3
+	var dirwcc nfstypes.Wcc_data
 	util.DPrintf(1, "NFS Create %v\n", args)
-	// XXX deal with how
+	var sattr = args.How.Obj_attributes
 	if args.How.Mode == nfstypes.EXCLUSIVE {
-		reply.Status = nfstypes.NFS3ERR_NOTSUPP
-		return reply
+		sattr = createVerf(args.How.Verf)
+	}
+	for {
+		op, err, fh3, fattr, dirwcc = nfs.doCreate(args.Where.Dir, args.Where.Name,
+			nfstypes.NF3REG, sattr, nil, nfstypes.Specdata3{})
+		if err != nfstypes.NFS3ERR_EXIST || args.How.Mode == nfstypes.GUARDED {
+			break
+		}
+		op.Abort()
+		op, err, fh3, fattr, dirwcc = nfs.createExisting(args)
+		if err != nfstypes.NFS3ERR_NOENT {
+			break
+		}
+		op.Abort() // name was removed; retry
 	}
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3REG, nil)
 	if err != nfstypes.NFS3_OK {
 		util.DPrintf(1, "Create %v\n", err)
 		errRet(op, &reply.Status, err)
@@ -450,6 +651,7 @@ func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
 	}
 	reply.Resok.Obj_attributes.Attributes_follow = true
 	reply.Resok.Obj_attributes.Attributes = fattr
+	reply.Resok.Dir_wcc = dirwcc
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -459,7 +661,8 @@ func (nfs *Nfs) NFSPROC3_MKDIR(args nfstypes.MKDIR3args) nfstypes.MKDIR3res {
 	var reply nfstypes.MKDIR3res
 
 	util.DPrintf(1, "NFS Mkdir %v\n", args)
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3DIR, nil)
+	op, err, fh3, fattr, dirwcc := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3DIR,
+		args.Attributes, nil, nfstypes.Specdata3{})
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -470,6 +673,7 @@ func (nfs *Nfs) NFSPROC3_MKDIR(args nfstypes.MKDIR3args) nfstypes.MKDIR3res {
 	}
 	reply.Resok.Obj_attributes.Attributes_follow = true
 	reply.Resok.Obj_attributes.Attributes = fattr
+	reply.Resok.Dir_wcc = dirwcc
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -479,7 +683,8 @@ func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3re
 	util.DPrintf(1, "NFS SymLink %v\n", args)
 
 	data := []byte(args.Symlink.Symlink_data)
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3LNK, data)
+	op, err, fh3, fattr, dirwcc := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3LNK,
+		args.Symlink.Symlink_attributes, data, nfstypes.Specdata3{})
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -490,7 +695,7 @@ func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3re
 	}
 	reply.Resok.Obj_attributes.Attributes_follow = true
 	reply.Resok.Obj_attributes.Attributes = fattr
-
+	reply.Resok.Dir_wcc = dirwcc
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -498,59 +703,115 @@ func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3re
 func (nfs *Nfs) NFSPROC3_READLINK(args nfstypes.READLINK3args) nfstypes.READLINK3res {
 	var reply nfstypes.READLINK3res
 	util.DPrintf(1, "NFS ReadLink %v\n", args)
-	op, data, _, err := nfs.doRead(args.Symlink, nfstypes.NF3LNK, uint64(0), uint64(0))
+	op, ip, data, _, err := nfs.doRead(args.Symlink, nfstypes.NF3LNK, uint64(0), uint64(0))
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 	}
+	reply.Resok.Symlink_attributes = postOp(ip)
 	reply.Resok.Data = nfstypes.Nfspath3(string(data))
 	commitReply(op, &reply.Status)
 	return reply
 }
 
+// Mknod makes FIFOs, sockets, and device nodes, which have no
+// contents; a device node records its major and minor number in Rdev.
+// As on a local file system, only root may make device nodes.
 func (nfs *Nfs) NFSPROC3_MKNOD(args nfstypes.MKNOD3args) nfstypes.MKNOD3res {
+	defer nfs.recordOp(nfstypes.NFSPROC3_MKNOD, time.Now())
 	var reply nfstypes.MKNOD3res
 	util.DPrintf(1, "NFS MakeNod %v\n", args)
-	err := nfstypes.NFS3ERR_NOTSUPP
-	util.DPrintf(2, "errRet %v", err)
-	reply.Status = err
+	var sattr nfstypes.Sattr3
+	var rdev nfstypes.Specdata3
+	kind := args.What.Ftype
+	if kind == nfstypes.NF3CHR || kind == nfstypes.NF3BLK {
+		if !nfs.cred.isRoot() {
+			reply.Status = nfstypes.NFS3ERR_PERM
+			return reply
+		}
+		sattr = args.What.Device.Dev_attributes
+		rdev = args.What.Device.Spec
+	} else if kind == nfstypes.NF3SOCK || kind == nfstypes.NF3FIFO {
+		sattr = args.What.Pipe_attributes
+	} else {
+		reply.Status = nfstypes.NFS3ERR_BADTYPE
+		return reply
+	}
+	op, err, fh3, fattr, dirwcc := nfs.doCreate(args.Where.Dir, args.Where.Name,
+		kind, sattr, nil, rdev)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &reply.Status, err)
+		return reply
+	}
+	reply.Resok.Obj = nfstypes.Post_op_fh3{
+		Handle_follows: true,
+		Handle:         fh3,
+	}
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = fattr
+	reply.Resok.Dir_wcc = dirwcc
+	commitReply(op, &reply.Status)
 	return reply
 }
 
-func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bool) (*fstxn.FsTxn, nfstypes.Nfsstat3) {
+func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bool) (*fstxn.FsTxn, nfstypes.Wcc_data, nfstypes.Nfsstat3) {
+	var dirwcc nfstypes.Wcc_data
 	if dir.IllegalName(name) {
 		util.DPrintf(0, "Remove inval name\n")
-		return nil, nfstypes.NFS3ERR_INVAL
+		return nil, dirwcc, nfstypes.NFS3ERR_INVAL
+	}
+	if dir.NameTooLong(name) {
+		return nil, dirwcc, nfstypes.NFS3ERR_NAMETOOLONG
 	}
 	op, inodes, err := nfs.getInodesLocked(dfh, name)
 	if err != nfstypes.NFS3_OK {
-		return op, err
+		return op, dirwcc, err
 	}
 	if isdir && inodes[0].Kind != nfstypes.NF3DIR {
 		util.DPrintf(0, "Remove not a directory %v\n", inodes[0].Kind)
-		return op, nfstypes.NFS3ERR_INVAL
+		return op, dirwcc, nfstypes.NFS3ERR_INVAL
+	}
+	if len(inodes) < 2 {
+		return op, dirwcc, nfstypes.NFS3ERR_INVAL
+	}
+	if !nfs.cred.mayDelete(inodes[1], inodes[0]) {
+		return op, dirwcc, nfstypes.NFS3ERR_ACCES
+	}
+	if !isdir && inodes[0].Kind == nfstypes.NF3DIR {
+		util.DPrintf(0, "Remove a directory\n")
+		return op, dirwcc, nfstypes.NFS3ERR_ISDIR
 	}
 	if isdir && !dir.IsDirEmpty(inodes[0], op) {
-		return op, nfstypes.NFS3ERR_INVAL
+		return op, dirwcc, nfstypes.NFS3ERR_INVAL
 	}
-	ok := dir.RemName(inodes[1], op, name)
+	pre := preOp(inodes[1])
+	ok, shrink := dir.RemName(inodes[1], op, name)
 	if !ok {
 		util.DPrintf(0, "Remove failed\n")
-		return op, nfstypes.NFS3ERR_IO
+		return op, dirwcc, nfstypes.NFS3ERR_IO
+	}
+	if shrink {
+		nfs.shrinkst.StartShrinker(inodes[1].Inum)
 	}
-	nfs.doDecLink(op, inodes[0])
-	return op, nfstypes.NFS3_OK
+	if isdir {
+		nfs.doDecLinkDir(op, inodes[1], inodes[0])
+	} else {
+		nfs.doDecLink(op, inodes[0])
+	}
+	dirwcc = mkWcc(pre, inodes[1])
+	return op, dirwcc, nfstypes.NFS3_OK
 }
 
 func (nfs *Nfs) NFSPROC3_REMOVE(args nfstypes.REMOVE3args) nfstypes.REMOVE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_REMOVE, time.Now())
 	var reply nfstypes.REMOVE3res
 	util.DPrintf(1, "NFS Remove %v\n", args)
-	op, err := nfs.doRemove(args.Object.Dir, args.Object.Name, false)
+	op, dirwcc, err := nfs.doRemove(args.Object.Dir, args.Object.Name, false)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 	}
+	reply.Resok.Dir_wcc = dirwcc
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -559,58 +820,87 @@ func (nfs *Nfs) NFSPROC3_RMDIR(args nfstypes.RMDIR3args) nfstypes.RMDIR3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_RMDIR, time.Now())
 	var reply nfstypes.RMDIR3res
 	util.DPrintf(1, "NFS Rmdir %v\n", args)
-	op, err := nfs.doRemove(args.Object.Dir, args.Object.Name, true)
+	op, dirwcc, err := nfs.doRemove(args.Object.Dir, args.Object.Name, true)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 	}
+	reply.Resok.Dir_wcc = dirwcc
 	commitReply(op, &reply.Status)
 	return reply
 }
 
-func validateRename(op *fstxn.FsTxn, inodes []*inode.Inode, fromfh fh.Fh, tofh fh.Fh,
+func validateRename(op *fstxn.FsTxn, dipfrom *inode.Inode, dipto *inode.Inode,
+	from *inode.Inode, to *inode.Inode, fromfh fh.Fh, tofh fh.Fh,
 	fromn nfstypes.Filename3, ton nfstypes.Filename3) bool {
-	var dipto *inode.Inode
-	var dipfrom *inode.Inode
-	var from *inode.Inode
-	var to *inode.Inode
-	if len(inodes) == 3 {
-		dipfrom = inodes[0]
-		dipto = inodes[0]
-		from = inodes[1]
-		to = inodes[2]
-	} else {
-		dipfrom = inodes[0]
-		dipto = inodes[1]
-		from = inodes[2]
-		to = inodes[3]
-	}
 	if dipfrom.Inum != fromfh.Ino || dipfrom.Gen != fromfh.Gen ||
 		dipto.Inum != tofh.Ino || dipto.Gen != tofh.Gen {
 		util.DPrintf(10, "revalidate ino failed\n")
 		return false
 	}
+	var toinum = common.NULLINUM
+	if to != nil {
+		toinum = to.Inum
+	}
 	frominum, _ := dir.LookupName(dipfrom, op, fromn)
-	toinum, _ := dir.LookupName(dipto, op, ton)
-	if from.Inum != frominum || toinum != to.Inum {
+	toinumLookup, _ := dir.LookupName(dipto, op, ton)
+	if from.Inum != frominum || toinumLookup != toinum {
 		util.DPrintf(10, "revalidate inums failed\n")
 		return false
 	}
 	return true
 }
 
+// isAncestor reports if inum is dinum or one of dinum's ancestors, by
+// following ".." up to the root.  The caller must hold renameMu, so
+// that no directory changes parent during the walk, and no inode
+// locks, since the walk locks inodes out of order.
+func (nfs *Nfs) isAncestor(inum common.Inum, dinum common.Inum) bool {
+	var cur = dinum
+	for cur != inum {
+		if cur == common.ROOTINUM {
+			return false
+		}
+		op := fstxn.Begin(nfs.fsstate)
+		dip := op.GetInodeInum(cur)
+		if dip == nil {
+			op.Abort()
+			return false
+		}
+		parent, _ := dir.LookupName(dip, op, "..")
+		op.Abort()
+		if parent == common.NULLINUM {
+			return false
+		}
+		cur = parent
+	}
+	return true
+}
+
+// Rename first looks up from and to with the directories locked, and
+// then locks the directories, from, and to (if it exists) in inum
+// order, revalidating the names.  If they changed in between, it
+// retries.  Renames between directories hold renameMu, and fail with
+// NFS3ERR_INVAL if they would move a directory into its own subtree.
 func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_RENAME, time.Now())
 	var reply nfstypes.RENAME3res
 	var dipto *inode.Inode
 	var dipfrom *inode.Inode
+	var from *inode.Inode
+	var to *inode.Inode
 	var op *fstxn.FsTxn
 	var inodes []*inode.Inode
-	var frominum common.Inum
-	var toinum common.Inum
+	var prefrom nfstypes.Pre_op_attr
+	var preto nfstypes.Pre_op_attr
 	var success bool = false
 	var done bool = false
 
+	if !fh.Equal(args.From.Dir, args.To.Dir) {
+		nfs.renameMu.Lock()
+		defer nfs.renameMu.Unlock()
+	}
+
 	for !success {
 		op = fstxn.Begin(nfs.fsstate)
 		util.DPrintf(1, "NFS Rename %v\n", args)
@@ -618,11 +908,16 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 		toh := fh.MakeFh(args.To.Dir)
 		fromh := fh.MakeFh(args.From.Dir)
 
-		if dir.IllegalName(args.From.Name) {
+		if dir.IllegalName(args.From.Name) || dir.IllegalName(args.To.Name) {
 			errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 			done = true
 			break
 		}
+		if dir.NameTooLong(args.From.Name) || dir.NameTooLong(args.To.Name) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_NAMETOOLONG)
+			done = true
+			break
+		}
 
 		if fh.Equal(args.From.Dir, args.To.Dir) {
 			dipfrom = op.GetInodeFh(args.From.Dir)
@@ -632,7 +927,6 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 				break
 			}
 			dipto = dipfrom
-			inodes = []*inode.Inode{dipfrom}
 		} else {
 			inodes = lockInodes(op, twoInums(fromh.Ino, toh.Ino))
 			if inodes == nil {
@@ -646,108 +940,203 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 
 		util.DPrintf(3, "from %v to %v\n", dipfrom, dipto)
 
-		frominumLookup, _ := dir.LookupName(dipfrom, op, args.From.Name)
-		frominum = frominumLookup
+		// check before looking up the names, so that a caller who
+		// may not change the directories can't tell which exist
+		if !nfs.cred.may(dipfrom, permWrite|permExec) ||
+			!nfs.cred.may(dipto, permWrite|permExec) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+			done = true
+			break
+		}
+
+		frominum, _ := dir.LookupName(dipfrom, op, args.From.Name)
 		if frominum == common.NULLINUM {
 			errRet(op, &reply.Status, nfstypes.NFS3ERR_NOENT)
 			done = true
 			break
 		}
-		util.DPrintf(3, "frominum %d toinum %d\n", frominum, toinum)
-
-		toInumLookup, _ := dir.LookupName(dipto, op, args.To.Name)
-		toinum = toInumLookup
+		toinum, _ := dir.LookupName(dipto, op, args.To.Name)
 
 		util.DPrintf(3, "frominum %d toinum %d\n", frominum, toinum)
 
-		// rename to itself?
-		if dipto == dipfrom && toinum == frominum {
-			reply.Status = nfstypes.NFS3_OK
-			op.Commit()
+		// must lock 3 or 4 inodes in order
+		op.Abort()
+		if dipfrom != dipto && nfs.isAncestor(frominum, dipto.Inum) {
+			reply.Status = nfstypes.NFS3ERR_INVAL
 			done = true
 			break
 		}
-
-		// does to exist?
+		op = fstxn.Begin(nfs.fsstate)
+		inums := []common.Inum{dipfrom.Inum, dipto.Inum, frominum}
+		if toinum != common.NULLINUM {
+			inums = append(inums, toinum)
+		}
+		inodes = lockInodes(op, inums)
+		if inodes == nil { // retry
+			continue
+		}
+		dipfrom = inodes[0]
+		dipto = inodes[1]
+		from = inodes[2]
+		to = nil
 		if toinum != common.NULLINUM {
-			// must lock 3 or 4 inodes in order
-			var to *inode.Inode
-			var from *inode.Inode
+			to = inodes[3]
+		}
+		util.DPrintf(1, "inodes %v\n", inodes)
+		if !validateRename(op, dipfrom, dipto, from, to, fromh, toh,
+			args.From.Name, args.To.Name) { // retry
 			op.Abort()
-			op = fstxn.Begin(nfs.fsstate)
-			if dipto != dipfrom {
-				inums := make([]common.Inum, 4)
-				inums[0] = dipfrom.Inum
-				inums[1] = dipto.Inum
-				inums[2] = frominum
-				inums[3] = toinum
-				inodes = lockInodes(op, inums)
-				dipfrom = inodes[0]
-				dipto = inodes[1]
-				from = inodes[2]
-				to = inodes[3]
-			} else {
-				inums := make([]common.Inum, 3)
-				inums[0] = dipfrom.Inum
-				inums[1] = frominum
-				inums[2] = toinum
-				inodes = lockInodes(op, inums)
-				dipfrom = inodes[0]
-				dipto = inodes[0]
-				from = inodes[1]
-				to = inodes[2]
+			continue
+		}
+		if !nfs.cred.mayDelete(dipfrom, from) ||
+			!nfs.cred.may(dipto, permWrite|permExec) ||
+			(to != nil && !nfs.cred.mayDelete(dipto, to)) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+			done = true
+			break
+		}
+		// rename to itself, or to another link of the same file?
+		if to == from {
+			reply.Resok.Fromdir_wcc = mkWcc(preOp(dipfrom), dipfrom)
+			reply.Resok.Todir_wcc = mkWcc(preOp(dipto), dipto)
+			commitReply(op, &reply.Status)
+			done = true
+			break
+		}
+		// a directory moving to dipto adds a link to dipto with its
+		// "..", unless it replaces a directory
+		if from.Kind == nfstypes.NF3DIR && dipfrom != dipto &&
+			to == nil && dipto.Nlink >= inode.MAXNLINK {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_MLINK)
+			done = true
+			break
+		}
+		prefrom = preOp(dipfrom)
+		preto = preOp(dipto)
+		if to != nil {
+			if to.Kind != from.Kind {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
+				done = true
+				break
 			}
-			util.DPrintf(1, "inodes %v\n", inodes)
-			if validateRename(op, inodes, fromh, toh,
-				args.From.Name, args.To.Name) {
-				if to.Kind != from.Kind {
-					errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-					done = true
-					break
-				}
-				if to.Kind == nfstypes.NF3DIR && !dir.IsDirEmpty(to, op) {
-					errRet(op, &reply.Status, nfstypes.NFS3ERR_NOTEMPTY)
-					done = true
-					break
-				}
-				ok := dir.RemName(dipto, op, args.To.Name)
-				if !ok {
-					errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
-					done = true
-					break
-				}
+			if to.Kind == nfstypes.NF3DIR && !dir.IsDirEmpty(to, op) {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_NOTEMPTY)
+				done = true
+				break
+			}
+			ok, shrink := dir.RemName(dipto, op, args.To.Name)
+			if !ok {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+				done = true
+				break
+			}
+			if shrink {
+				nfs.shrinkst.StartShrinker(dipto.Inum)
+			}
+			if to.Kind == nfstypes.NF3DIR {
+				nfs.doDecLinkDir(op, dipto, to)
+			} else {
 				nfs.doDecLink(op, to)
-				success = true
-			} else { // retry
-				op.Abort()
 			}
-		} else {
-			success = true
 		}
+		success = true
 	}
 	if done {
 		return reply
 	}
-	ok := dir.RemName(dipfrom, op, args.From.Name)
+	ok, shrink := dir.RemName(dipfrom, op, args.From.Name)
 	if !ok {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 		return reply
 	}
-	ok1 := dir.AddName(dipto, op, frominum, args.To.Name)
+	if shrink {
+		nfs.shrinkst.StartShrinker(dipfrom.Inum)
+	}
+	ok1 := dir.AddName(dipto, op, from.Inum, args.To.Name)
 	if !ok1 {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
 		return reply
 	}
+	if from.Kind == nfstypes.NF3DIR && dipfrom != dipto {
+		if !dir.SetDotDot(from, op, dipto.Inum) || !dipto.IncLink(op.Atxn) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+			return reply
+		}
+		dipfrom.DecLink(op.Atxn)
+	}
+	reply.Resok.Fromdir_wcc = mkWcc(prefrom, dipfrom)
+	reply.Resok.Todir_wcc = mkWcc(preto, dipto)
 	commitReply(op, &reply.Status)
 	return reply
 }
 
+// Lock the inode for args.File and the directory args.Link.Dir in
+// inum order, and add a name for the file to the directory.
 func (nfs *Nfs) NFSPROC3_LINK(args nfstypes.LINK3args) nfstypes.LINK3res {
+	defer nfs.recordOp(nfstypes.NFSPROC3_LINK, time.Now())
 	var reply nfstypes.LINK3res
 	util.DPrintf(1, "NFS Link %v\n", args)
-	err := nfstypes.NFS3ERR_NOTSUPP
-	util.DPrintf(2, "errRet %v", err)
-	reply.Status = err
+	op := fstxn.Begin(nfs.fsstate)
+	if dir.IllegalName(args.Link.Name) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_EXIST)
+		return reply
+	}
+	if dir.NameTooLong(args.Link.Name) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NAMETOOLONG)
+		return reply
+	}
+	if !fh.Valid(args.File) || !fh.Valid(args.Link.Dir) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_BADHANDLE)
+		return reply
+	}
+	fileh := fh.MakeFh(args.File)
+	dirh := fh.MakeFh(args.Link.Dir)
+	if fileh.Ino == dirh.Ino {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ISDIR)
+		return reply
+	}
+	inodes := lockInodes(op, twoInums(fileh.Ino, dirh.Ino))
+	if inodes == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	ip := inodes[0]
+	dip := inodes[1]
+	if ip.Gen != fileh.Gen || dip.Gen != dirh.Gen {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ISDIR)
+		return reply
+	}
+	if dip.Kind != nfstypes.NF3DIR {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOTDIR)
+		return reply
+	}
+	if !nfs.cred.may(dip, permWrite|permExec) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
+	inum, _ := dir.LookupName(dip, op, args.Link.Name)
+	if inum != common.NULLINUM {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_EXIST)
+		return reply
+	}
+	pre := preOp(dip)
+	if !ip.IncLink(op.Atxn) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_MLINK)
+		return reply
+	}
+	ok := dir.AddName(dip, op, ip.Inum, args.Link.Name)
+	if !ok {
+		ip.DecLink(op.Atxn)
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
+		return reply
+	}
+	reply.Resok.File_attributes = postOp(ip)
+	reply.Resok.Linkdir_wcc = mkWcc(pre, dip)
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -764,7 +1153,17 @@ func (nfs *Nfs) NFSPROC3_READDIR(args nfstypes.READDIR3args) nfstypes.READDIR3re
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
+	if !nfs.cred.may(ip, permRead) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
+	if args.Cookie != 0 && args.Cookieverf != dir.CookieVerf(ip) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_BAD_COOKIE)
+		return reply
+	}
 	dirlist := Readdir3(ip, op, args.Cookie, args.Count)
+	reply.Resok.Dir_attributes = postOp(ip)
+	reply.Resok.Cookieverf = dir.CookieVerf(ip)
 	reply.Resok.Reply = dirlist
 	commitReply(op, &reply.Status)
 	return reply
@@ -784,7 +1183,17 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
+	if !nfs.cred.may(ip, permRead) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
+	if args.Cookie != 0 && args.Cookieverf != dir.CookieVerf(ip) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_BAD_COOKIE)
+		return reply
+	}
 	dirlist := Ls3(ip, op, args.Cookie, args.Dircount, args.Maxcount)
+	reply.Resok.Dir_attributes = postOp(ip)
+	reply.Resok.Cookieverf = dir.CookieVerf(ip)
 	reply.Resok.Reply = dirlist
 	commitReply(op, &reply.Status)
 	return reply
@@ -793,7 +1202,22 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 func (nfs *Nfs) NFSPROC3_FSSTAT(args nfstypes.FSSTAT3args) nfstypes.FSSTAT3res {
 	var reply nfstypes.FSSTAT3res
 	util.DPrintf(1, "NFS FsStat %v\n", args)
-	reply.Status = nfstypes.NFS3ERR_NOTSUPP
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Fsroot)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	tblocks, fblocks := nfs.fsstate.Bcount.Counts()
+	tinodes, finodes := nfs.fsstate.Icount.Counts()
+	reply.Resok.Obj_attributes = postOp(ip)
+	reply.Resok.Tbytes = nfstypes.Size3(tblocks * disk.BlockSize)
+	reply.Resok.Fbytes = nfstypes.Size3(fblocks * disk.BlockSize)
+	reply.Resok.Abytes = reply.Resok.Fbytes
+	reply.Resok.Tfiles = nfstypes.Size3(tinodes)
+	reply.Resok.Ffiles = nfstypes.Size3(finodes)
+	reply.Resok.Afiles = reply.Resok.Ffiles
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -801,15 +1225,26 @@ func (nfs *Nfs) NFSPROC3_FSINFO(args nfstypes.FSINFO3args) nfstypes.FSINFO3res {
 	var reply nfstypes.FSINFO3res
 	util.DPrintf(1, "NFS FsInfo %v\n", args)
 	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Fsroot)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	reply.Resok.Obj_attributes = postOp(ip)
 	reply.Resok.Rtmax = 16 * 4096
 	reply.Resok.Rtmult = 4096
 	reply.Resok.Rtpref = reply.Resok.Rtmax
-	reply.Resok.Wtmax = nfstypes.Uint32(jrnl.LogBytes)
+	reply.Resok.Wtmax = nfstypes.Uint32(WTMAX)
 	reply.Resok.Wtpref = 16 * 4096
 	reply.Resok.Wtmult = 4096
 	reply.Resok.Dtpref = 16 * 4096
-	reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize())
-	reply.Resok.Properties = nfstypes.Uint32(nfstypes.FSF3_HOMOGENEOUS | nfstypes.FSF3_SYMLINK)
+	if nfs.fsstate.Super.BlockMap {
+		reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxBmapSize())
+	} else {
+		reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize())
+	}
+	reply.Resok.Properties = nfstypes.Uint32(nfstypes.FSF3_LINK |
+		nfstypes.FSF3_HOMOGENEOUS | nfstypes.FSF3_SYMLINK)
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -817,11 +1252,18 @@ func (nfs *Nfs) NFSPROC3_FSINFO(args nfstypes.FSINFO3args) nfstypes.FSINFO3res {
 func (nfs *Nfs) NFSPROC3_PATHCONF(args nfstypes.PATHCONF3args) nfstypes.PATHCONF3res {
 	var reply nfstypes.PATHCONF3res
 	util.DPrintf(1, "NFS PathConf %v\n", args)
-	reply.Status = nfstypes.NFS3_OK
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Object)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	reply.Resok.Obj_attributes = postOp(ip)
 	reply.Resok.Name_max = nfstypes.Uint32(dir.MAXNAMELEN)
 	reply.Resok.No_trunc = true
-	reply.Resok.Linkmax = 1
+	reply.Resok.Linkmax = nfstypes.Uint32(inode.MAXNLINK)
 	reply.Resok.Case_preserving = true
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -846,9 +1288,18 @@ func (nfs *Nfs) NFSPROC3_COMMIT(args nfstypes.COMMIT3args) nfstypes.COMMIT3res {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
-	ok := op.CommitFh()
+	// RFC: "If count is 0, a flush from offset to the end of file
+	// is done."
+	var end = uint64(args.Offset) + uint64(args.Count)
+	if args.Count == 0 {
+		end = ip.Size
+	}
+	// flushing doesn't change the attributes
+	reply.Resok.File_wcc = mkWcc(preOp(ip), ip)
+	ok := op.CommitFh(ip.Inum, uint64(args.Offset), end)
 	if ok {
 		reply.Status = nfstypes.NFS3_OK
+		reply.Resok.Verf = nfs.verf
 	} else {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 	}
@@ -3,13 +3,18 @@ package nfs
 import (
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/tchajed/goose/machine/disk"
@@ -17,17 +22,20 @@ import (
 	"testing"
 
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 
 	"github.com/stretchr/testify/assert"
 )
 
 var quiet = flag.Bool("quiet", false, "disable logging")
 
-const DISKSZ uint64 = 10 * 1000
+// 256-byte inodes take 2048 blocks of the disk
+const DISKSZ uint64 = 12 * 1000
 
 func checkFlags() {
 	if *quiet {
@@ -151,7 +159,8 @@ func (ts *TestState) ReadLink(fh nfstypes.Nfs_fh3) string {
 }
 
 func (ts *TestState) ReadDirPlus() nfstypes.Dirlistplus3 {
-	reply := ts.clnt.ReadDirPlusOp(fh.MkRootFh3(), inode.NDIRECT*disk.BlockSize)
+	reply := ts.clnt.ReadDirPlusOp(fh.MkRootFh3(), 0, nfstypes.Cookieverf3{},
+		inode.NDIRECT*disk.BlockSize)
 	assert.Equal(ts.t, reply.Status, nfstypes.NFS3_OK)
 	return reply.Resok.Reply
 }
@@ -181,6 +190,11 @@ func (ts *TestState) RenameFail(from string, to string) {
 	assert.Equal(ts.t, nfstypes.NFS3ERR_NOTEMPTY, status)
 }
 
+func (ts *TestState) Link(fh3 nfstypes.Nfs_fh3, name string, err nfstypes.Nfsstat3) {
+	reply := ts.clnt.LinkOp(fh3, fh.MkRootFh3(), name)
+	assert.Equal(ts.t, err, reply.Status)
+}
+
 func mkdata(sz uint64) []byte {
 	data := make([]byte, sz)
 	for i := range data {
@@ -274,6 +288,303 @@ func TestReadDir(t *testing.T) {
 	}
 }
 
+// readDirAll reads all entries of dir with READDIR, count bytes at a
+// time
+func (ts *TestState) readDirAll(dir nfstypes.Nfs_fh3, count uint64) map[string]nfstypes.Fileid3 {
+	names := make(map[string]nfstypes.Fileid3)
+	var cookie nfstypes.Cookie3 = 0
+	var verf nfstypes.Cookieverf3
+	for {
+		reply := ts.clnt.ReadDirOp(dir, cookie, verf, count)
+		assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+		verf = reply.Resok.Cookieverf
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			_, ok := names[string(e.Name)]
+			assert.False(ts.t, ok, "duplicate entry %v", e.Name)
+			names[string(e.Name)] = e.Fileid
+			cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			break
+		}
+	}
+	return names
+}
+
+func TestIndexedDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newTest(t)
+	defer ts.Close()
+
+	// enough entries for a tree with two levels of inner nodes
+	const N = 8000
+	root := fh.MkRootFh3()
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	for i := 0; i < N; i++ {
+		ts.CreateFh(d, "f"+strconv.Itoa(i))
+	}
+	assert.Less(t, uint64(disk.BlockSize), uint64(ts.GetattrDir(d).Size))
+	names := ts.readDirAll(d, 1000)
+	assert.Equal(t, N+2, len(names))
+	assert.Equal(t, ts.GetattrDir(d).Fileid, names["."])
+	assert.Equal(t, ts.GetattrDir(root).Fileid, names[".."])
+
+	for i := 0; i < N; i += 2 {
+		reply := ts.clnt.RemoveOp(d, "f"+strconv.Itoa(i))
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	}
+	assert.NotEqual(t, nfstypes.NFS3_OK, ts.clnt.RmDirOp(root, "d").Status)
+
+	// the index survives a restart
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	for i := 0; i < N; i++ {
+		reply := ts.clnt.LookupOp(d, "f"+strconv.Itoa(i))
+		if i%2 == 0 {
+			assert.Equal(t, nfstypes.NFS3ERR_NOENT, reply.Status)
+		} else {
+			assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		}
+	}
+	names = ts.readDirAll(d, 1000)
+	assert.Equal(t, N/2+2, len(names))
+	assert.Equal(t, ts.GetattrDir(root).Fileid, ts.GetattrDir(ts.LookupFh(d, "..")).Fileid)
+
+	for i := 1; i < N; i += 2 {
+		reply := ts.clnt.RemoveOp(d, "f"+strconv.Itoa(i))
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	}
+	assert.Equal(t, 2, len(ts.readDirAll(d, 1000)))
+	ts.RmDir("d", nfstypes.NFS3_OK)
+}
+
+func TestDirCompact(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newTest(t)
+	defer ts.Close()
+
+	const N = 4000
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	for i := 0; i < N; i++ {
+		ts.CreateFh(d, "f"+strconv.Itoa(i))
+	}
+	attr := ts.GetattrDir(d)
+
+	// start a READDIR, then remove most entries
+	reply := ts.clnt.ReadDirOp(d, 0, nfstypes.Cookieverf3{}, 1000)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	verf := reply.Resok.Cookieverf
+	names := make(map[string]bool)
+	var cookie nfstypes.Cookie3 = 0
+	for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		names[string(e.Name)] = true
+		cookie = e.Cookie
+	}
+	for i := 0; i < N; i++ {
+		if i%10 != 0 {
+			reply := ts.clnt.RemoveOp(d, "f"+strconv.Itoa(i))
+			assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		}
+	}
+	assert.Less(t, uint64(ts.GetattrDir(d).Size), uint64(attr.Size)/3)
+	assert.Less(t, uint64(ts.GetattrDir(d).Used), uint64(attr.Used)/3)
+
+	// the READDIR resumes where it left off
+	for {
+		reply := ts.clnt.ReadDirOp(d, cookie, verf, 1000)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			assert.False(t, names[string(e.Name)], "duplicate entry %v", e.Name)
+			names[string(e.Name)] = true
+			cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			break
+		}
+	}
+	for i := 0; i < N; i += 10 {
+		assert.True(t, names["f"+strconv.Itoa(i)])
+	}
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	assert.Equal(t, N/10+2, len(ts.readDirAll(d, 1000)))
+	for i := 0; i < N; i += 10 {
+		reply := ts.clnt.RemoveOp(d, "f"+strconv.Itoa(i))
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	}
+	assert.Equal(t, 2*disk.BlockSize, uint64(ts.GetattrDir(d).Size))
+	ts.CreateFh(d, "f")
+	assert.Equal(t, 3, len(ts.readDirAll(d, 1000)))
+}
+
+func TestDirMergeLeftmost(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newTest(t)
+	defer ts.Close()
+
+	// long names, for a tree with two levels of inner nodes
+	const N = 4000
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	names := make([]string, N)
+	for i := 0; i < N; i++ {
+		names[i] = strings.Repeat("f", 200) + strconv.Itoa(i)
+		ts.CreateFh(d, names[i])
+	}
+	attr := ts.GetattrDir(d)
+
+	// removing names in the order of their hash, the directory's key,
+	// empties the leftmost leaf of each inner node first, which merges
+	// with its right sibling, and the truncation of the directory
+	// moves leftmost leaves to free nodes
+	hash := func(name string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		return h.Sum64()
+	}
+	sort.Slice(names, func(i, j int) bool { return hash(names[i]) < hash(names[j]) })
+	for _, name := range names[:N-N/10] {
+		reply := ts.clnt.RemoveOp(d, name)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	}
+	assert.Less(t, uint64(ts.GetattrDir(d).Size), uint64(attr.Size)/3)
+	for _, name := range names[N-N/10:] {
+		ts.LookupFh(d, name)
+	}
+	assert.Equal(t, N/10+2, len(ts.readDirAll(d, 1000)))
+}
+
+func TestCookieVerf(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	for i := 0; i < 10; i++ {
+		ts.CreateFh(d, "f"+strconv.Itoa(i))
+	}
+	reply := ts.clnt.ReadDirOp(d, 0, nfstypes.Cookieverf3{}, 100)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.False(t, reply.Resok.Reply.Eof)
+	e := reply.Resok.Reply.Entries
+	assert.Equal(t, nfstypes.Filename3("."), e.Name)
+	assert.NotEqual(t, nfstypes.Cookie3(0), e.Cookie)
+	for e.Nextentry != nil {
+		e = e.Nextentry
+	}
+	verf := reply.Resok.Cookieverf
+
+	// the verifier survives a restart and changes to the directory
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	ts.CreateFh(d, "g")
+	reply = ts.clnt.ReadDirOp(d, e.Cookie, verf, 100)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, verf, reply.Resok.Cookieverf)
+
+	// switching to the indexed format invalidates cookies
+	for i := 10; i < 200; i++ {
+		ts.CreateFh(d, "f"+strconv.Itoa(i))
+	}
+	reply = ts.clnt.ReadDirOp(d, e.Cookie, verf, 100)
+	assert.Equal(t, nfstypes.NFS3ERR_BAD_COOKIE, reply.Status)
+	reply = ts.clnt.ReadDirOp(d, 0, verf, 100)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.NotEqual(t, verf, reply.Resok.Cookieverf)
+	assert.Equal(t, 203, len(ts.readDirAll(d, 100)))
+}
+
+func TestDcacheEvict(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	// more entries than the dcache holds, but still a linear directory
+	const N = 2 * dir.DCACHESZ
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	for i := uint64(0); i < N; i++ {
+		ts.CreateFh(d, "f"+strconv.FormatUint(i, 10))
+	}
+	assert.Equal(t, disk.BlockSize, uint64(ts.GetattrDir(d).Size))
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	for i := uint64(0); i < N; i++ {
+		ts.LookupFh(d, "f"+strconv.FormatUint(i, 10))
+	}
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, ts.clnt.LookupOp(d, "g").Status)
+	for i := uint64(0); i < N; i += 2 {
+		reply := ts.clnt.RemoveOp(d, "f"+strconv.FormatUint(i, 10))
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	}
+	for i := uint64(0); i < N; i++ {
+		reply := ts.clnt.LookupOp(d, "f"+strconv.FormatUint(i, 10))
+		if i%2 == 0 {
+			assert.Equal(t, nfstypes.NFS3ERR_NOENT, reply.Status)
+		} else {
+			assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		}
+	}
+	assert.Equal(t, N/2+2, uint64(len(ts.readDirAll(d, 1000))))
+}
+
+// longName returns a name of n bytes ending in i
+func longName(n int, i int) string {
+	s := strconv.Itoa(i)
+	return strings.Repeat("x", n-len(s)) + s
+}
+
+func TestLongNames(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	reply := ts.clnt.PathconfOp(root)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Uint32(dir.MAXNAMELEN), reply.Resok.Name_max)
+
+	// enough names to convert the directory and split its leaves
+	const N = 100
+	max := int(dir.MAXNAMELEN)
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	for i := 0; i < N; i++ {
+		ts.CreateFh(d, longName(max-i%2, i))
+	}
+	names := ts.readDirAll(d, 1000)
+	assert.Equal(t, N+2, len(names))
+	for i := 0; i < N; i++ {
+		_, ok := names[longName(max-i%2, i)]
+		assert.True(t, ok)
+	}
+
+	long := longName(max+1, 0)
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, ts.clnt.CreateOp(d, long).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, ts.clnt.LookupOp(d, long).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, ts.clnt.MkDirOp(d, long).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, ts.clnt.RemoveOp(d, long).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG,
+		ts.clnt.RenameOp(d, longName(max, 0), d, long))
+	f := ts.LookupFh(d, longName(max, 0))
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, ts.clnt.LinkOp(f, d, long).Status)
+
+	for i := 0; i < N; i++ {
+		reply := ts.clnt.RemoveOp(d, longName(max-i%2, i))
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	}
+	assert.Equal(t, 2, len(ts.readDirAll(d, 1000)))
+	ts.RmDir("d", nfstypes.NFS3_OK)
+}
+
 // Grow file with setattr before writing
 func TestOneFile(t *testing.T) {
 	ts := newTest(t)
@@ -282,7 +593,7 @@ func TestOneFile(t *testing.T) {
 	sz := uint64(8192)
 	ts.Create("x")
 	attr := ts.GetattrDir(fh.MkRootFh3())
-	assert.Equal(t, 3*dir.DIRENTSZ, uint64(attr.Size))
+	assert.Equal(t, disk.BlockSize, uint64(attr.Size))
 	fh := ts.Lookup("x", true)
 	ts.Getattr(fh, 0)
 	data := mkdata(sz)
@@ -391,6 +702,46 @@ func TestSymLink(t *testing.T) {
 	assert.Equal(ts.t, "x", p)
 }
 
+func TestMknod(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	spec := nfstypes.Specdata3{Specdata1: 8, Specdata2: 1}
+	kinds := []nfstypes.Ftype3{nfstypes.NF3CHR, nfstypes.NF3BLK,
+		nfstypes.NF3SOCK, nfstypes.NF3FIFO}
+	for i, k := range kinds {
+		name := "n" + strconv.Itoa(i)
+		reply := ts.clnt.MknodOp(root, name, k, spec)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		attr := ts.clnt.GetattrOp(ts.Lookup(name, true)).Resok.Obj_attributes
+		assert.Equal(t, k, attr.Ftype)
+		if k == nfstypes.NF3CHR || k == nfstypes.NF3BLK {
+			assert.Equal(t, spec, attr.Rdev)
+		} else {
+			assert.Equal(t, nfstypes.Specdata3{}, attr.Rdev)
+		}
+	}
+	reply := ts.clnt.MknodOp(root, "n0", nfstypes.NF3FIFO, spec)
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+	reply = ts.clnt.MknodOp(root, "r", nfstypes.NF3REG, spec)
+	assert.Equal(t, nfstypes.NFS3ERR_BADTYPE, reply.Status)
+
+	// only root makes devices
+	user := ts.clnt.AsUser(MkCred(1000, 1000, nil))
+	reply = user.MknodOp(root, "d", nfstypes.NF3CHR, spec)
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, reply.Status)
+	reply = user.MknodOp(root, "p", nfstypes.NF3FIFO, spec)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Uid3(1000), reply.Resok.Obj_attributes.Attributes.Uid)
+
+	// Rdev survives a restart
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	attr := ts.clnt.GetattrOp(ts.Lookup("n0", true)).Resok.Obj_attributes
+	assert.Equal(t, spec, attr.Rdev)
+}
+
 func TestRename(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -413,6 +764,407 @@ func TestRename(t *testing.T) {
 	ts.RenameFhs(d1, "f1", d2, "f1")
 }
 
+func TestLink(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Link(x, "y", nfstypes.NFS3_OK)
+	y := ts.Lookup("y", true)
+	assert.Equal(t, x, y)
+	attr := ts.Getattr(y, 0)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+
+	data := mkdata(100)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+	ts.readcheck(y, 0, data)
+
+	ts.Link(x, "y", nfstypes.NFS3ERR_EXIST)
+	ts.Link(x, ".", nfstypes.NFS3ERR_EXIST)
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	ts.Link(d, "e", nfstypes.NFS3ERR_ISDIR)
+
+	// a handle the server didn't hand out
+	short := nfstypes.Nfs_fh3{Data: x.Data[:8]}
+	reply := ts.clnt.LinkOp(short, fh.MkRootFh3(), "z")
+	assert.Equal(t, nfstypes.NFS3ERR_BADHANDLE, reply.Status)
+	reply = ts.clnt.LinkOp(x, short, "z")
+	assert.Equal(t, nfstypes.NFS3ERR_BADHANDLE, reply.Status)
+	ts.Lookup("z", false)
+
+	// renaming one link over another of the same file is a no-op
+	ts.Rename("x", "y")
+	ts.Lookup("x", true)
+
+	ts.Remove("x")
+	_ = ts.Lookup("x", false)
+	attr = ts.Getattr(y, uint64(len(data)))
+	assert.Equal(t, nfstypes.Uint32(1), attr.Nlink)
+	ts.readcheck(y, 0, data)
+	ts.Remove("y")
+	ts.GetattrFail(y)
+}
+
+func TestModeOwner(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sattr := nfstypes.Sattr3{
+		Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0640},
+		Uid:  nfstypes.Set_uid3{Set_it: true, Uid: 1000},
+		Gid:  nfstypes.Set_gid3{Set_it: true, Gid: 100},
+	}
+	reply := ts.clnt.CreateAttrOp(fh.MkRootFh3(), "x", sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	x := ts.Lookup("x", true)
+	attr := ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Mode3(0640), attr.Mode)
+	assert.Equal(t, nfstypes.Uid3(1000), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(100), attr.Gid)
+
+	chmod := nfstypes.Sattr3{
+		Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0755},
+		Gid:  nfstypes.Set_gid3{Set_it: true, Gid: 200},
+	}
+	sreply := ts.clnt.SetattrAttrOp(x, chmod)
+	assert.Equal(t, nfstypes.NFS3_OK, sreply.Status)
+	assert.Equal(t, nfstypes.Mode3(0755), sreply.Resok.Obj_wcc.After.Attributes.Mode)
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = MakeNfs(d)
+	attr = ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Mode3(0755), attr.Mode)
+	assert.Equal(t, nfstypes.Uid3(1000), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(200), attr.Gid)
+}
+
+func TestAccess(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	sattr := nfstypes.Sattr3{
+		Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0640},
+		Uid:  nfstypes.Set_uid3{Set_it: true, Uid: 1000},
+		Gid:  nfstypes.Set_gid3{Set_it: true, Gid: 100},
+	}
+	reply := ts.clnt.CreateAttrOp(root, "x", sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	x := ts.Lookup("x", true)
+
+	owner := ts.clnt.AsUser(MkCred(1000, 1000, nil))
+	group := ts.clnt.AsUser(MkCred(2000, 2000, []uint32{100}))
+	other := ts.clnt.AsUser(MkCred(3000, 3000, nil))
+
+	all := uint32(nfstypes.ACCESS3_READ | nfstypes.ACCESS3_MODIFY |
+		nfstypes.ACCESS3_EXTEND | nfstypes.ACCESS3_EXECUTE)
+	rw := uint32(nfstypes.ACCESS3_READ | nfstypes.ACCESS3_MODIFY |
+		nfstypes.ACCESS3_EXTEND)
+	assert.Equal(t, nfstypes.Uint32(rw), owner.AccessOp(x, all).Resok.Access)
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_READ), group.AccessOp(x, all).Resok.Access)
+	assert.Equal(t, nfstypes.Uint32(0), other.AccessOp(x, all).Resok.Access)
+
+	data := mkdata(100)
+	assert.Equal(t, nfstypes.NFS3_OK, owner.WriteOp(x, 0, data, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, group.WriteOp(x, 0, data, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, group.ReadOp(x, 0, 100).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, other.ReadOp(x, 0, 100).Status)
+
+	chown := nfstypes.Sattr3{Uid: nfstypes.Set_uid3{Set_it: true, Uid: 3000}}
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, owner.SetattrAttrOp(x, chown).Status)
+	chmod := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0644}}
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, group.SetattrAttrOp(x, chmod).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, owner.SetattrAttrOp(x, chmod).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, other.ReadOp(x, 0, 100).Status)
+
+	// a write clears setuid, but only if it writes something
+	setuid := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 04644}}
+	assert.Equal(t, nfstypes.NFS3_OK, owner.SetattrAttrOp(x, setuid).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, owner.WriteOp(x, 0, []byte{}, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.Mode3(04644), ts.Getattr(x, 100).Mode)
+	assert.Equal(t, nfstypes.NFS3_OK, owner.WriteOp(x, 0, data, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.Mode3(0644), ts.Getattr(x, 100).Mode)
+
+	// a directory only root may write into
+	dattr := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0755}}
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(d, dattr).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, owner.CreateOp(d, "y").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, owner.RenameOp(root, "x", d, "x"))
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, owner.LinkOp(x, d, "x").Status)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.CreateOp(d, "w").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, owner.RenameOp(d, "w", d, "w"))
+
+	// in a sticky directory, only the owner may rename a file, even
+	// over another link of itself
+	sticky := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 01777}}
+	ts.MkDir("t")
+	td := ts.Lookup("t", true)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(td, sticky).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, owner.CreateOp(td, "w").Status)
+	w := owner.LookupOp(td, "w").Resok.Object
+	assert.Equal(t, nfstypes.NFS3_OK, owner.LinkOp(w, td, "w2").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, other.RenameOp(td, "w", td, "w2"))
+	assert.Equal(t, nfstypes.NFS3_OK, owner.RenameOp(td, "w", td, "w2"))
+
+	// a directory only root may search doesn't tell others which names
+	// it holds
+	sattr = nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0700}}
+	ts.MkDir("s")
+	s := ts.Lookup("s", true)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(s, sattr).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.CreateOp(s, "y").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, owner.LookupOp(s, "y").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, owner.LookupOp(s, "none").Status)
+
+	// new files belong to their creator
+	assert.Equal(t, nfstypes.NFS3_OK, other.CreateOp(root, "z").Status)
+	z := ts.Lookup("z", true)
+	attr := ts.Getattr(z, 0)
+	assert.Equal(t, nfstypes.Uid3(3000), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(3000), attr.Gid)
+}
+
+func (ts *TestState) Fsstat() nfstypes.FSSTAT3resok {
+	reply := ts.clnt.FsstatOp(fh.MkRootFh3())
+	assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+	return reply.Resok
+}
+
+func TestFsstat(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.Fsstat()
+	assert.Less(t, uint64(st.Fbytes), uint64(st.Tbytes))
+	assert.Less(t, uint64(st.Ffiles), uint64(st.Tfiles))
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Write(x, mkdata(3*disk.BlockSize), nfstypes.FILE_SYNC)
+	st1 := ts.Fsstat()
+	assert.Equal(t, st.Tbytes, st1.Tbytes)
+	assert.Equal(t, st.Ffiles-1, st1.Ffiles)
+	assert.Equal(t, st.Fbytes-nfstypes.Size3(3*disk.BlockSize), st1.Fbytes)
+
+	ts.Remove("x")
+	ts.clnt.srv.shrinkst.Shutdown() // wait for the shrinker
+	st2 := ts.Fsstat()
+	assert.Equal(t, st.Ffiles, st2.Ffiles)
+	assert.Equal(t, st.Fbytes, st2.Fbytes)
+
+	// counters start from the bitmaps after a restart
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = MakeNfs(d)
+	assert.Equal(t, st2, ts.Fsstat())
+}
+
+func timeLess(t0 nfstypes.Nfstime3, t1 nfstypes.Nfstime3) bool {
+	return t0.Seconds < t1.Seconds ||
+		(t0.Seconds == t1.Seconds && t0.Nseconds < t1.Nseconds)
+}
+
+func TestTimes(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	r0 := ts.GetattrDir(root)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	r1 := ts.GetattrDir(root)
+	assert.True(t, timeLess(r0.Mtime, r1.Mtime), "create updates dir mtime")
+	assert.True(t, timeLess(r0.Ctime, r1.Ctime), "create updates dir ctime")
+
+	x0 := ts.Getattr(x, 0)
+	ts.Write(x, mkdata(100), nfstypes.FILE_SYNC)
+	x1 := ts.Getattr(x, 100)
+	assert.True(t, timeLess(x0.Mtime, x1.Mtime), "write updates mtime")
+	assert.True(t, timeLess(x0.Ctime, x1.Ctime), "write updates ctime")
+
+	chmod := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0600}}
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(x, chmod).Status)
+	x2 := ts.Getattr(x, 100)
+	assert.Equal(t, x1.Mtime, x2.Mtime)
+	assert.True(t, timeLess(x1.Ctime, x2.Ctime), "setattr updates ctime")
+
+	ts.Setattr(x, 0)
+	x3 := ts.Getattr(x, 0)
+	assert.True(t, timeLess(x2.Mtime, x3.Mtime), "truncate updates mtime")
+
+	d0 := ts.GetattrDir(d)
+	ts.RenameFhs(root, "x", d, "x")
+	r2 := ts.GetattrDir(root)
+	d1 := ts.GetattrDir(d)
+	assert.True(t, timeLess(r1.Mtime, r2.Mtime), "rename updates from dir")
+	assert.True(t, timeLess(d0.Mtime, d1.Mtime), "rename updates to dir")
+
+	ts.clnt.Shutdown()
+	dsk := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = MakeNfs(dsk)
+	assert.Equal(t, d1, ts.GetattrDir(d))
+}
+
+func TestCreateModes(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	excl := nfstypes.Createhow3{
+		Mode: nfstypes.EXCLUSIVE,
+		Verf: nfstypes.Createverf3{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	reply := ts.clnt.CreateHowOp(root, "lock", excl)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	lock := reply.Resok.Obj.Handle
+
+	// a retransmission succeeds, another creator doesn't
+	reply = ts.clnt.CreateHowOp(root, "lock", excl)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, lock, reply.Resok.Obj.Handle)
+	other := excl
+	other.Verf[7] = 9
+	reply = ts.clnt.CreateHowOp(root, "lock", other)
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+
+	guarded := nfstypes.Createhow3{Mode: nfstypes.GUARDED}
+	reply = ts.clnt.CreateHowOp(root, "lock", guarded)
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+
+	// the verifier survives a restart
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = MakeNfs(d)
+	reply = ts.clnt.CreateHowOp(root, "lock", excl)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+
+	// UNCHECKED applies the size to an existing file
+	ts.Write(lock, mkdata(4096), nfstypes.FILE_SYNC)
+	reply = ts.clnt.CreateHowOp(root, "lock", nfstypes.Createhow3{})
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Size3(4096), reply.Resok.Obj_attributes.Attributes.Size)
+	trunc := nfstypes.Createhow3{
+		Obj_attributes: nfstypes.Sattr3{
+			Size: nfstypes.Set_size3{Set_it: true, Size: 0},
+		},
+	}
+	reply = ts.clnt.CreateHowOp(root, "lock", trunc)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, lock, reply.Resok.Obj.Handle)
+	ts.Getattr(lock, 0)
+
+	ts.MkDir("d")
+	reply = ts.clnt.CreateHowOp(root, "d", trunc)
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+}
+
+func TestWcc(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	r0 := ts.GetattrDir(root)
+	creply := ts.clnt.CreateOp(root, "x")
+	assert.Equal(t, nfstypes.NFS3_OK, creply.Status)
+	dwcc := creply.Resok.Dir_wcc
+	assert.True(t, dwcc.Before.Attributes_follow)
+	assert.Equal(t, r0.Mtime, dwcc.Before.Attributes.Mtime)
+	assert.Equal(t, r0.Size, dwcc.Before.Attributes.Size)
+	assert.True(t, dwcc.After.Attributes_follow)
+	assert.Equal(t, ts.GetattrDir(root), dwcc.After.Attributes)
+
+	x := creply.Resok.Obj.Handle
+	wreply := ts.clnt.WriteOp(x, 0, mkdata(100), nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3_OK, wreply.Status)
+	assert.Equal(t, nfstypes.Size3(0), wreply.Resok.File_wcc.Before.Attributes.Size)
+	assert.Equal(t, nfstypes.Size3(100), wreply.Resok.File_wcc.After.Attributes.Size)
+
+	lreply := ts.clnt.LookupOp(root, "x")
+	assert.Equal(t, nfstypes.NFS3_OK, lreply.Status)
+	assert.True(t, lreply.Resok.Dir_attributes.Attributes_follow)
+	assert.Equal(t, nfstypes.Fileid3(common.ROOTINUM),
+		lreply.Resok.Dir_attributes.Attributes.Fileid)
+	lreply = ts.clnt.LookupOp(root, "y")
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, lreply.Status)
+	assert.True(t, lreply.Resfail.Dir_attributes.Attributes_follow)
+
+	rreply := ts.clnt.ReadOp(x, 0, 100)
+	assert.Equal(t, nfstypes.NFS3_OK, rreply.Status)
+	assert.Equal(t, nfstypes.Size3(100), rreply.Resok.File_attributes.Attributes.Size)
+
+	r1 := ts.GetattrDir(root)
+	rmreply := ts.clnt.RemoveOp(root, "x")
+	assert.Equal(t, nfstypes.NFS3_OK, rmreply.Status)
+	assert.Equal(t, r1.Mtime, rmreply.Resok.Dir_wcc.Before.Attributes.Mtime)
+	assert.Equal(t, ts.GetattrDir(root), rmreply.Resok.Dir_wcc.After.Attributes)
+}
+
+func TestDirNlink(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	assert.Equal(t, nfstypes.Uint32(2), ts.GetattrDir(root).Nlink)
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	assert.Equal(t, nfstypes.Uint32(2), ts.GetattrDir(d).Nlink)
+	assert.Equal(t, nfstypes.Uint32(3), ts.GetattrDir(root).Nlink)
+	ts.RmDir("d", nfstypes.NFS3_OK)
+	ts.GetattrFail(d)
+	assert.Equal(t, nfstypes.Uint32(2), ts.GetattrDir(root).Nlink)
+}
+
+func TestRenameDir(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	ts.MkDir("a")
+	ts.MkDir("b")
+	a := ts.Lookup("a", true)
+	b := ts.Lookup("b", true)
+	reply := ts.clnt.MkDirOp(a, "c")
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	c := ts.LookupFh(a, "c")
+	assert.Equal(t, nfstypes.Uint32(3), ts.GetattrDir(a).Nlink)
+
+	// moving c to b rewrites its ".." and moves the link
+	ts.RenameFhs(a, "c", b, "c")
+	assert.Equal(t, ts.GetattrDir(b).Fileid, ts.GetattrDir(ts.LookupFh(c, "..")).Fileid)
+	assert.Equal(t, nfstypes.Uint32(2), ts.GetattrDir(a).Nlink)
+	assert.Equal(t, nfstypes.Uint32(3), ts.GetattrDir(b).Nlink)
+	assert.Equal(t, nfstypes.Uint32(2), ts.GetattrDir(c).Nlink)
+	assert.Equal(t, nfstypes.Uint32(4), ts.GetattrDir(root).Nlink)
+
+	// b can't move into itself or its subtree
+	status := ts.clnt.RenameOp(root, "b", b, "x")
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, status)
+	status = ts.clnt.RenameOp(root, "b", c, "x")
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, status)
+	ts.LookupFh(b, "c")
+
+	// replacing an empty directory in a keeps a's link count
+	reply = ts.clnt.MkDirOp(a, "e")
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Uint32(3), ts.GetattrDir(a).Nlink)
+	ts.RenameFhs(b, "c", a, "e")
+	assert.Equal(t, ts.GetattrDir(a).Fileid, ts.GetattrDir(ts.LookupFh(c, "..")).Fileid)
+	assert.Equal(t, nfstypes.Uint32(3), ts.GetattrDir(a).Nlink)
+	assert.Equal(t, nfstypes.Uint32(2), ts.GetattrDir(b).Nlink)
+
+	// renames within a directory leave ".." alone
+	ts.RenameFhs(a, "e", a, "c")
+	assert.Equal(t, ts.GetattrDir(a).Fileid, ts.GetattrDir(ts.LookupFh(c, "..")).Fileid)
+	assert.Equal(t, nfstypes.Uint32(3), ts.GetattrDir(a).Nlink)
+}
+
 func TestUnstable(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -435,6 +1187,90 @@ func TestUnstable(t *testing.T) {
 	ts.readcheck(x, 0, data2)
 }
 
+func TestCommitFile(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.Create("x")
+	ts.Create("y")
+	sz := uint64(4096)
+	x := ts.Lookup("x", true)
+	y := ts.Lookup("y", true)
+	xino := fh.MakeFh(x).Ino
+	yino := fh.MakeFh(y).Ino
+	pending := ts.clnt.srv.fsstate.Pending
+	unstable := func(ino common.Inum, off uint64, end uint64) bool {
+		u, _ := pending.Unstable(ino, off, end)
+		return u
+	}
+
+	data := mkdata(sz)
+	ts.WriteOff(y, 0, data, nfstypes.FILE_SYNC)
+	ts.WriteOff(x, 0, data, nfstypes.UNSTABLE)
+	ts.WriteOff(x, 2*sz, data, nfstypes.UNSTABLE)
+	assert.True(t, unstable(xino, 0, sz))
+	assert.False(t, unstable(xino, sz, 2*sz))
+	assert.False(t, unstable(yino, 0, sz))
+
+	// y has no unstable writes, and the range of x's COMMIT has none,
+	// so neither flushes the log
+	reply := ts.clnt.CommitOp(y, sz)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	reply = ts.clnt.CommitRangeOp(x, sz, sz)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.True(t, unstable(xino, 0, sz))
+	assert.True(t, unstable(xino, 2*sz, 3*sz))
+
+	// flushing for x also makes y's write durable
+	ts.WriteOff(y, sz, data, nfstypes.UNSTABLE)
+	reply = ts.clnt.CommitRangeOp(x, 2*sz, sz)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.False(t, unstable(xino, 0, 3*sz))
+	assert.False(t, unstable(yino, 0, 2*sz))
+
+	// a count of 0 commits to the end of the file
+	ts.WriteOff(x, 3*sz, data, nfstypes.UNSTABLE)
+	assert.True(t, unstable(xino, 3*sz, 4*sz))
+	reply = ts.clnt.CommitRangeOp(x, 2*sz, 0)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.False(t, unstable(xino, 0, 4*sz))
+
+	// a synchronous write of y flushes the log, which makes x's writes
+	// durable without a COMMIT
+	ts.WriteOff(x, 0, data, nfstypes.UNSTABLE)
+	ts.WriteOff(x, 2*sz, data, nfstypes.UNSTABLE)
+	assert.True(t, unstable(xino, 0, 3*sz))
+	ts.WriteOff(y, 0, data, nfstypes.FILE_SYNC)
+	assert.False(t, unstable(xino, 0, 3*sz))
+}
+
+func TestWriteVerf(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+
+	data := mkdata(4096)
+	wreply := ts.clnt.WriteOp(x, 0, data, nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3_OK, wreply.Status)
+	verf := wreply.Resok.Verf
+	creply := ts.clnt.CommitOp(x, 4096)
+	assert.Equal(t, nfstypes.NFS3_OK, creply.Status)
+	assert.Equal(t, verf, creply.Resok.Verf)
+
+	// an unstable write the crash may lose
+	wreply = ts.clnt.WriteOp(x, 4096, data, nfstypes.UNSTABLE)
+	assert.Equal(t, verf, wreply.Resok.Verf)
+	ts.clnt.Crash()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = MakeNfs(d)
+	wreply = ts.clnt.WriteOp(x, 0, data, nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3_OK, wreply.Status)
+	assert.NotEqual(t, verf, wreply.Resok.Verf)
+	creply = ts.clnt.CommitOp(x, 4096)
+	assert.Equal(t, wreply.Resok.Verf, creply.Resok.Verf)
+}
+
 func TestConcurWriteFiles(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -557,6 +1393,126 @@ func TestConcurRename(t *testing.T) {
 	wg.Wait()
 }
 
+// readDirPlusAll reads all entries of dir with READDIRPLUS, and
+// returns how many entries of each name it saw
+func (ts *TestState) readDirPlusAll(dir nfstypes.Nfs_fh3) map[string]int {
+	names := make(map[string]int)
+	var cookie nfstypes.Cookie3 = 0
+	var verf nfstypes.Cookieverf3
+	for {
+		reply := ts.clnt.ReadDirPlusOp(dir, cookie, verf, 1000)
+		assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+		verf = reply.Resok.Cookieverf
+		e := reply.Resok.Reply.Entries
+		if !reply.Resok.Reply.Eof {
+			assert.NotNil(ts.t, e)
+		}
+		for ; e != nil; e = e.Nextentry {
+			if e.Name_attributes.Attributes_follow {
+				assert.Equal(ts.t, e.Fileid, e.Name_attributes.Attributes.Fileid)
+			}
+			names[string(e.Name)] += 1
+			cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			break
+		}
+	}
+	return names
+}
+
+func TestConcurReadDirPlus(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	// interleave lock acquisitions even on one CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	const NGO = 4
+	const NF = 5
+	const N = 50
+
+	// the f files have lower inums than d, the g files higher
+	root := fh.MkRootFh3()
+	for i := 0; i < NGO*NF; i++ {
+		ts.Create("f" + strconv.Itoa(i))
+	}
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	for i := 0; i < NGO*NF; i++ {
+		ts.RenameFhs(root, "f"+strconv.Itoa(i), d, "f"+strconv.Itoa(i))
+	}
+	for i := 0; i < NF; i++ {
+		ts.CreateFh(d, "g"+strconv.Itoa(i))
+	}
+
+	// entries with lower inums than d come without attributes, instead
+	// of ending the reply early
+	var nent = 0
+	var ncall = 0
+	var cookie nfstypes.Cookie3 = 0
+	var verf nfstypes.Cookieverf3
+	for {
+		reply := ts.clnt.ReadDirPlusOp(d, cookie, verf, 64*1024)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		verf = reply.Resok.Cookieverf
+		ncall++
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			low := strings.HasPrefix(string(e.Name), "f") || e.Name == ".."
+			assert.Equal(t, !low, e.Name_attributes.Attributes_follow)
+			assert.Equal(t, !low, e.Name_handle.Handle_follows)
+			cookie = e.Cookie
+			nent++
+		}
+		if reply.Resok.Reply.Eof {
+			break
+		}
+	}
+	assert.Equal(t, NGO*NF+NF+2, nent)
+	assert.LessOrEqual(t, ncall, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < NGO; i++ {
+		wg.Add(2)
+		go func(id int) {
+			for i := 0; i < N; i++ {
+				for j := id * NF; j < (id+1)*NF; j++ {
+					from := "f" + strconv.Itoa(j)
+					to := "h" + strconv.Itoa(j)
+					assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.RenameOp(d, from, d, to))
+					assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.RenameOp(d, to, d, from))
+				}
+			}
+			wg.Done()
+		}(i)
+		go func() {
+			for i := 0; i < N; i++ {
+				names := ts.readDirPlusAll(d)
+				assert.Equal(t, 1, names["."])
+				assert.Equal(t, 1, names[".."])
+				for j := 0; j < NF; j++ {
+					assert.Equal(t, 1, names["g"+strconv.Itoa(j)])
+				}
+			}
+			wg.Done()
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(60 * time.Second):
+		t.Fatal("READDIRPLUS deadlocked with RENAME")
+	}
+
+	// children with lower inums than d show up, without attributes
+	names := ts.readDirPlusAll(d)
+	assert.Equal(t, NGO*NF+NF+2, len(names))
+}
+
 func TestFileHole(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -572,6 +1528,232 @@ func TestFileHole(t *testing.T) {
 	ts.readcheck(fh, 0, null)
 }
 
+func TestSparseRead(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sz := uint64(4096)
+	null := mkdataval(0, sz)
+	data := mkdataval(1, sz)
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	ts.Setattr(fh, inode.MaxFileSize())
+	off := (inode.NDIRECT + disk.BlockSize/8 + 10) * sz
+	ts.WriteOff(fh, off, data, nfstypes.FILE_SYNC)
+
+	// reading holes, before, between, and after extents, allocates
+	// nothing
+	free := ts.Fsstat().Fbytes
+	ts.readcheck(fh, 0, null)
+	ts.readcheck(fh, (inode.NDIRECT+1)*sz, null)
+	ts.readcheck(fh, off-sz, null)
+	ts.readcheck(fh, off+sz, null)
+	ts.readcheck(fh, inode.MaxFileSize()-sz, null)
+	ts.readcheck(fh, off, data)
+	assert.Equal(t, free, ts.Fsstat().Fbytes)
+}
+
+func TestUsed(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sz := uint64(4096)
+	data := mkdataval(1, sz)
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	free := ts.Fsstat().Fbytes
+	assert.Equal(t, nfstypes.Size3(0), ts.Getattr(fh, 0).Used)
+
+	ts.WriteOff(fh, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.Size3(sz), ts.Getattr(fh, sz).Used)
+
+	// a block further on is a second extent in the inode; the hole in
+	// between uses nothing
+	off := (inode.NDIRECT + 10) * sz
+	ts.WriteOff(fh, off, data, nfstypes.FILE_SYNC)
+	used := ts.Getattr(fh, off+sz).Used
+	assert.Equal(t, nfstypes.Size3(2*sz), used)
+	assert.Equal(t, free-nfstypes.Size3(used), ts.Fsstat().Fbytes)
+
+	ts.Setattr(fh, inode.MaxFileSize())
+	assert.Equal(t, used, ts.Getattr(fh, inode.MaxFileSize()).Used)
+
+	ts.Setattr(fh, sz)
+	ts.clnt.srv.shrinkst.Shutdown() // wait for the shrinker
+	assert.Equal(t, nfstypes.Size3(sz), ts.Getattr(fh, sz).Used)
+	ts.Setattr(fh, 0)
+	assert.Equal(t, nfstypes.Size3(0), ts.Getattr(fh, 0).Used)
+	assert.Equal(t, free, ts.Fsstat().Fbytes)
+}
+
+func TestInline(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	free := ts.Fsstat().Fbytes
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	data := mkdata(inode.INLINESZ)
+	ts.Write(fh, data[:100], nfstypes.FILE_SYNC)
+	ts.WriteOff(fh, 100, data[100:], nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.Size3(0), ts.Getattr(fh, inode.INLINESZ).Used)
+	assert.Equal(t, free, ts.Fsstat().Fbytes)
+	ts.readcheck(fh, 0, data)
+
+	// growing by SETATTR leaves a hole, and truncation zeroes the tail
+	sz := uint64(3 * disk.BlockSize)
+	ts.Setattr(fh, sz)
+	assert.Equal(t, nfstypes.Size3(0), ts.Getattr(fh, sz).Used)
+	ts.readcheck(fh, inode.INLINESZ, make([]byte, sz-inode.INLINESZ))
+	ts.Setattr(fh, 50)
+	ts.Setattr(fh, inode.INLINESZ)
+	want := make([]byte, inode.INLINESZ)
+	copy(want, data[:50])
+	ts.readcheck(fh, 0, want)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	ts.readcheck(fh, 0, want)
+
+	// writing beyond the inode moves the data to a block
+	ts.WriteOff(fh, inode.INLINESZ, []byte("x"), nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.Size3(disk.BlockSize), ts.Getattr(fh, inode.INLINESZ+1).Used)
+	ts.readcheck(fh, 0, append(want, 'x'))
+	ts.Remove("x")
+	assert.Equal(t, free, ts.Fsstat().Fbytes)
+
+	short := "short/target"
+	long := strings.Repeat("long/", 100)
+	ts.SymLink("s", short)
+	ts.SymLink("l", long)
+	s := ts.Lookup("s", true)
+	l := ts.Lookup("l", true)
+	assert.Equal(t, nfstypes.Size3(0), ts.clnt.GetattrOp(s).Resok.Obj_attributes.Used)
+	assert.Equal(t, nfstypes.Size3(disk.BlockSize), ts.clnt.GetattrOp(l).Resok.Obj_attributes.Used)
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	assert.Equal(t, short, ts.ReadLink(s))
+	assert.Equal(t, long, ts.ReadLink(l))
+}
+
+func TestExtents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newTest(t)
+	defer ts.Close()
+
+	sz := uint64(4096)
+	free := ts.Fsstat().Fbytes
+
+	// a sequential file is one run of blocks, without extent nodes
+	const N = inode.NEXT + 10
+	x := ts.writeLargeFile("x", N)
+	assert.Equal(t, nfstypes.Size3(N*sz), ts.Getattr(x, N*sz).Used)
+
+	// blocks spread over many terabytes need two levels of nodes
+	const M = inode.NROOTEXT*inode.NEXT + 10
+	step := inode.MaxFileSize() / M / sz * sz
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	for i := uint64(0); i < M; i++ {
+		ts.WriteOff(y, i*step, mkdataval(byte(i), sz), nfstypes.UNSTABLE)
+	}
+	ts.Commit(y, M*step)
+	used := uint64(ts.Getattr(y, (M-1)*step+sz).Used)
+	assert.Less(t, M*sz, used)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	for i := uint64(0); i < N; i++ {
+		ts.readcheck(x, i*sz, mkdataval(byte(i), sz))
+	}
+	for i := uint64(0); i < M; i++ {
+		ts.readcheck(y, i*step, mkdataval(byte(i), sz))
+	}
+	ts.readcheck(y, step-sz, mkdataval(0, sz))
+
+	// shrinking frees the extents beyond the new size and their nodes
+	ts.Setattr(y, (M/2)*step)
+	ts.clnt.srv.shrinkst.Shutdown()
+	for i := uint64(0); i < M/2; i++ {
+		ts.readcheck(y, i*step, mkdataval(byte(i), sz))
+	}
+	assert.LessOrEqual(t, uint64(ts.Getattr(y, (M/2)*step).Used), used-(M-M/2)*sz)
+	ts.Setattr(y, sz)
+	ts.clnt.srv.shrinkst.Shutdown()
+	assert.Equal(t, nfstypes.Size3(sz), ts.Getattr(y, sz).Used)
+	ts.readcheck(y, 0, mkdataval(0, sz))
+
+	ts.Remove("x")
+	ts.Remove("y")
+	ts.clnt.srv.shrinkst.Shutdown()
+	assert.Equal(t, free, ts.Fsstat().Fbytes)
+}
+
+func TestHugeSparse(t *testing.T) {
+	for _, blockmap := range []bool{true, false} {
+		ts := newTest(t)
+		ts.clnt.srv.SetBlockMap(blockmap)
+
+		sz := uint64(4096)
+		gib := uint64(1 << 30)
+		free := ts.Fsstat().Fbytes
+		ts.Create("x")
+		fh := ts.Lookup("x", true)
+
+		// a block in the direct blocks, the indirect, the double, and
+		// three in the triple indirect tree
+		offs := []uint64{0, 256 * sz, gib / 2, 3 * gib, 100 * gib,
+			inode.MaxBmapSize() - sz}
+		for i, off := range offs {
+			ts.WriteOff(fh, off, mkdataval(byte(i+1), sz), nfstypes.FILE_SYNC)
+		}
+		if blockmap {
+			reply := ts.clnt.WriteOp(fh, inode.MaxBmapSize(), mkdata(sz),
+				nfstypes.FILE_SYNC)
+			assert.Equal(t, nfstypes.NFS3ERR_NOSPC, reply.Status)
+		}
+		size := inode.MaxBmapSize()
+		used := uint64(ts.Getattr(fh, size).Used)
+		assert.Equal(t, free-nfstypes.Size3(used), ts.Fsstat().Fbytes)
+
+		ts.clnt.Shutdown()
+		ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+		ts.clnt.srv.SetBlockMap(blockmap)
+		for i, off := range offs {
+			ts.readcheck(fh, off, mkdataval(byte(i+1), sz))
+			if off > 0 {
+				ts.readcheck(fh, off-sz, mkdataval(0, sz))
+			}
+		}
+
+		// truncating frees the blocks beyond 2 GiB and, for blks, the
+		// 7 blocks of the triple indirect tree
+		var ntree uint64 = 0
+		if blockmap {
+			ntree = 7
+		}
+		ts.Setattr(fh, 2*gib)
+		ts.clnt.srv.shrinkst.Shutdown()
+		assert.Equal(t, nfstypes.Size3(used-(3+ntree)*sz), ts.Getattr(fh, 2*gib).Used)
+		for i, off := range offs[:3] {
+			ts.readcheck(fh, off, mkdataval(byte(i+1), sz))
+		}
+		ts.ReadEof(fh, 2*gib, sz)
+
+		// growing again reads zeros where the blocks were
+		ts.Setattr(fh, size)
+		ts.readcheck(fh, 3*gib, mkdataval(0, sz))
+		ts.readcheck(fh, size-sz, mkdataval(0, sz))
+		ts.Setattr(fh, 0)
+		ts.clnt.srv.shrinkst.Shutdown()
+		assert.Equal(t, nfstypes.Size3(0), ts.Getattr(fh, 0).Used)
+		assert.Equal(t, free, ts.Fsstat().Fbytes)
+		ts.Close()
+	}
+}
+
 func TestManyHoles(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -704,13 +1886,126 @@ func TestBigWrite(t *testing.T) {
 	ts.Write(x, data, nfstypes.UNSTABLE)
 	ts.Commit(x, sz)
 
+	// Larger than the log, at an unaligned offset
+	ts.Create("y")
+	sz = 2*jrnl.LogBytes + 10
+	y := ts.Lookup("y", true)
+	for i, how := range []nfstypes.Stable_how{nfstypes.UNSTABLE,
+		nfstypes.DATA_SYNC, nfstypes.FILE_SYNC} {
+		data = mkdataval(byte(i+1), sz)
+		ts.WriteOff(y, 100, data, how)
+		ts.readcheck(y, 100, data)
+	}
+	ts.Commit(y, sz)
+
 	// Too big
+	ts.Create("z")
+	z := ts.Lookup("z", true)
+	data = mkdataval(byte(0), WTMAX+4096)
+	ts.WriteErr(z, data, nfstypes.UNSTABLE, nfstypes.NFS3ERR_INVAL)
+	ts.CommitErr(z, WTMAX+4096, nfstypes.NFS3ERR_INVAL)
+
+	// A write that runs out of space reports the bytes it wrote
+	data = mkdataval(byte(7), WTMAX)
+	var off uint64 = 0
+	for {
+		reply := ts.clnt.WriteOp(z, off, data, nfstypes.UNSTABLE)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		cnt := uint64(reply.Resok.Count)
+		off += cnt
+		// the file may change between chunks
+		assert.Equal(t, cnt <= WRITECHUNK, reply.Resok.File_wcc.Before.Attributes_follow)
+		if cnt < WTMAX {
+			assert.Equal(t, nfstypes.Size3(off),
+				reply.Resok.File_wcc.After.Attributes.Size)
+			ts.readcheck(z, off-cnt, data[:cnt])
+			break
+		}
+	}
+}
+
+func TestBypass(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.clnt.srv.SetBypass(true)
+
+	// the full blocks in the middle go directly to disk, the partial
+	// ones at the ends through the log
+	sz := uint64(4096 * 20)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdataval(byte(1), sz)
+	ts.WriteOff(x, 100, data, nfstypes.UNSTABLE)
+	ts.readcheck(x, 100, data)
+
+	// existing blocks go through the log
+	data2 := mkdataval(byte(2), 2*4096)
+	ts.WriteOff(x, 4096, data2, nfstypes.UNSTABLE)
+	copy(data[4096-100:], data2)
+	ts.readcheck(x, 100, data)
+	ts.Commit(x, sz)
+
+	// x's blocks, some of which were written through the log, are
+	// reused for y
+	ts.Remove("x")
 	ts.Create("y")
-	sz = uint64(4096 * (common.HDRADDRS + 10))
 	y := ts.Lookup("y", true)
-	data = mkdataval(byte(0), sz)
-	ts.WriteErr(y, data, nfstypes.UNSTABLE, nfstypes.NFS3ERR_INVAL)
-	ts.CommitErr(y, sz, nfstypes.NFS3ERR_INVAL)
+	data3 := mkdataval(byte(3), 2*sz)
+	ts.Write(y, data3, nfstypes.DATA_SYNC)
+	ts.readcheck(y, 0, data3)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	ts.clnt.srv.SetBypass(true)
+	ts.Lookup("x", false)
+	y = ts.Lookup("y", true)
+	ts.readcheck(y, 0, data3)
+	data4 := mkdataval(byte(4), sz)
+	ts.WriteOff(y, 2*sz, data4, nfstypes.FILE_SYNC)
+	ts.readcheck(y, 0, data3)
+	ts.readcheck(y, 2*sz, data4)
+}
+
+func TestBypassReuseCrash(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.clnt.srv.SetBypass(true)
+
+	// fill the disk except for the space of g, so that each round
+	// below reuses the blocks it frees
+	sz := uint64(4096 * 20)
+	ts.Create("g")
+	g := ts.Lookup("g", true)
+	ts.Write(g, mkdataval(byte(1), sz), nfstypes.FILE_SYNC)
+	ts.maketoolargefile("f", 50)
+	ts.Remove("g")
+
+	// each round frees the blocks of a file that the log wrote, and
+	// reuses them right away for a file whose writes may go directly
+	// to disk; neither installing the log's writes of the old file nor
+	// recovering them after the crash may overwrite the new file
+	for i := 0; i < 4; i++ {
+		ts.Create("x")
+		x := ts.Lookup("x", true)
+		data := mkdataval(byte(2*i+1), sz)
+		ts.Write(x, data, nfstypes.UNSTABLE)
+		ts.Write(x, data, nfstypes.FILE_SYNC)
+		ts.Remove("x")
+
+		ts.Create("y")
+		y := ts.Lookup("y", true)
+		data2 := mkdataval(byte(2*i+2), sz)
+		ts.Write(y, data2, nfstypes.UNSTABLE)
+		ts.Commit(y, sz)
+		ts.clnt.Crash()
+
+		ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+		ts.clnt.srv.SetBypass(true)
+		ts.Lookup("x", false)
+		y = ts.Lookup("y", true)
+		ts.readcheck(y, 0, data2)
+		ts.Remove("y")
+	}
 }
 
 func TestBigUnlink(t *testing.T) {
@@ -805,6 +2100,44 @@ func TestRestartPersist(t *testing.T) {
 	ts.Lookup("y", true)
 }
 
+func TestFormat(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	ts.clnt.Shutdown()
+
+	// a disk with a file system but without this format's magic
+	// number, like one of an older layout, doesn't mount
+	super := ts.clnt.srv.fsstate.Super
+	blk := super.Disk.Read(uint64(super.ReservedStart()))
+	super.Disk.Write(uint64(super.ReservedStart()), make(disk.Block, disk.BlockSize))
+	assert.Panics(t, func() { MakeNfs(super.Disk) })
+
+	super.Disk.Write(uint64(super.ReservedStart()), blk)
+	ts.clnt.srv = MakeNfs(super.Disk)
+	ts.Lookup("x", true)
+	ts.clnt.Shutdown()
+
+	// a crash after mkfs made the root directory, but before it
+	// recorded that it was done
+	super.WriteFormat(false)
+	ts.clnt.srv = MakeNfs(super.Disk)
+	ts.Lookup("x", true)
+}
+
+func TestMkfsCrash(t *testing.T) {
+	// a crash before mkfs made the root directory
+	d := disk.NewMemDisk(DISKSZ)
+	fs := super.MkFsSuper(d)
+	fs.WriteFormat(false)
+	makeFs(fs)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: MakeNfs(d)}}
+	defer ts.Close()
+	ts.Create("x")
+	ts.Lookup("x", true)
+}
+
 func TestAbortRestart(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -818,6 +2151,14 @@ func TestAbortRestart(t *testing.T) {
 	assert.Equal(ts.t, nfstypes.NFS3ERR_NOSPC, attr.Status)
 	// d better not exist
 	ts.Lookup("d", false)
+	// the root directory runs out of space for names
+	for i := 0; ; i++ {
+		reply := ts.clnt.CreateOp(fh.MkRootFh3(), "f"+strconv.Itoa(i))
+		if reply.Status != nfstypes.NFS3_OK {
+			assert.Equal(ts.t, nfstypes.NFS3ERR_NOSPC, reply.Status)
+			break
+		}
+	}
 	ts.clnt.Shutdown()
 
 	d := ts.clnt.srv.fsstate.Super.Disk
@@ -836,6 +2177,10 @@ func TestRestartReclaim(t *testing.T) {
 	sz := ts.maketoolargefile("x", 50)
 	fhx3 := ts.Lookup("x", true)
 	fhx := fh.MakeFh(fhx3)
+
+	// the shrinker frees x in one transaction, so stop it first; the
+	// server crashes before x is shrunk
+	ts.clnt.srv.shrinkst.Crash()
 	ts.Remove("x")
 	ts.clnt.Crash()
 
@@ -843,16 +2188,59 @@ func TestRestartReclaim(t *testing.T) {
 	ts.clnt.srv = MakeNfs(d)
 	ts.Lookup("x", false)
 
-	// Create will try re-allocate inode fhx.Ino, but abort since
-	// it must be shrunk first (because above the server
-	// ''crashed'' immediately after remove). Then, retrying,
-	// Create will allocate the next inode.
+	// The server shrank x's inode when it restarted, so its space is
+	// free and Create re-allocates the inode right away.
+	assert.GreaterOrEqual(ts.t, uint64(ts.Fsstat().Fbytes), sz)
 	ts.Create("x")
 	fh3 := ts.Lookup("x", true)
 	fht := fh.MakeFh(fh3)
-	assert.Equal(ts.t, fhx.Ino+1, fht.Ino)
+	assert.Equal(ts.t, fhx.Ino, fht.Ino)
 
 	ts.maketoolargefile("y", 50)
 	fhx3 = ts.Lookup("y", true)
 	ts.Getattr(fhx3, sz)
 }
+
+func TestScavenge(t *testing.T) {
+	for _, blockmap := range []bool{true, false} {
+		ts := newTest(t)
+		ts.clnt.srv.SetBlockMap(blockmap)
+
+		ts.Create("x")
+		ts.Create("y")
+		x := ts.Lookup("x", true)
+		y := ts.Lookup("y", true)
+		free := ts.Fsstat().Fbytes
+		const N = 3000 // blocks, too many to free in one transaction
+		sz := uint64(N * 4096)
+		data := mkdataval(byte(1), sz)
+		for off := uint64(0); off < sz; off += WTMAX {
+			var n = sz - off
+			if n > WTMAX {
+				n = WTMAX
+			}
+			ts.WriteOff(x, off, data[off:off+n], nfstypes.FILE_SYNC)
+			ts.WriteOff(y, off, data[off:off+n], nfstypes.FILE_SYNC)
+		}
+
+		// the server crashes with x truncated and y removed, but
+		// neither shrunk
+		ts.clnt.srv.shrinkst.Crash()
+		newsz := sz/3 + 100
+		ts.Setattr(x, newsz)
+		ts.Remove("y")
+		ts.clnt.Crash()
+
+		ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+		ts.clnt.srv.SetBlockMap(blockmap)
+		n, nblk := ts.clnt.srv.shrinkst.Scavenge()
+		assert.Equal(t, uint64(0), n, "restart reclaims everything")
+		assert.Equal(t, uint64(0), nblk)
+
+		attr := ts.Getattr(x, newsz)
+		assert.Equal(t, free-attr.Used, ts.Fsstat().Fbytes)
+		ts.readcheck(x, 0, data[:newsz])
+		ts.Lookup("y", false)
+		ts.Close()
+	}
+}
@@ -0,0 +1,157 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// An RPC server for the MOUNT and NFS programs.  It follows
+// rfc1057.Server, whose handlers don't get the credential of the call,
+// except that it decodes the credential of each call and runs the NFS
+// procedure on an Nfs bound to it.
+//
+
+type Server struct {
+	nfs   *Nfs
+	mount []xdr.ProcRegistration
+}
+
+// reqBufPool holds buffers for incoming requests, like rfc1057's
+var reqBufPool sync.Pool
+
+func getReqBuf(buflen int) []byte {
+	bufi := reqBufPool.Get()
+	if bufi != nil {
+		buf := bufi.([]byte)
+		if buflen <= cap(buf) {
+			return buf[:buflen]
+		}
+	}
+	return make([]byte, buflen)
+}
+
+func putReqBuf(buf []byte) {
+	reqBufPool.Put(buf)
+}
+
+func MkServer(nfs *Nfs) *Server {
+	return &Server{
+		nfs:   nfs,
+		mount: nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(nfs),
+	}
+}
+
+func (srv *Server) Run(rw io.ReadWriter) error {
+	for {
+		var hdr [4]byte
+		_, err := io.ReadFull(rw, hdr[:])
+		if err != nil {
+			return err
+		}
+		hlen := binary.BigEndian.Uint32(hdr[:])
+		if hlen&(1<<31) == 0 {
+			return fmt.Errorf("fragments not supported")
+		}
+		buf := getReqBuf(int(hlen & 0x7fffffff))
+		_, err = io.ReadFull(rw, buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer putReqBuf(buf)
+			err := srv.handleReq(rw, buf)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}()
+	}
+}
+
+// call runs proc of prog on behalf of cred, and returns its result and
+// the accept status
+func (srv *Server) call(prog uint32, vers uint32, proc uint32, cred *Cred, rd *xdr.XdrState) (xdr.Xdrable, rfc1057.Accept_stat) {
+	var regs []xdr.ProcRegistration
+	if prog == nfstypes.MOUNT_PROGRAM {
+		if vers != nfstypes.MOUNT_V3 {
+			return nil, rfc1057.PROG_MISMATCH
+		}
+		regs = srv.mount
+	} else if prog == nfstypes.NFS_PROGRAM {
+		if vers != nfstypes.NFS_V3 {
+			return nil, rfc1057.PROG_MISMATCH
+		}
+		regs = nfstypes.NFS_PROGRAM_NFS_V3_regs(srv.nfs.WithCred(cred))
+	} else {
+		return nil, rfc1057.PROG_UNAVAIL
+	}
+	for _, r := range regs {
+		if r.Proc == proc {
+			res, err := r.Handler(rd)
+			if err != nil {
+				return nil, rfc1057.GARBAGE_ARGS
+			}
+			return res, rfc1057.SUCCESS
+		}
+	}
+	return nil, rfc1057.PROC_UNAVAIL
+}
+
+func (srv *Server) handleReq(w io.Writer, buf []byte) error {
+	rd := xdr.MakeReader(buf)
+
+	var req rfc1057.Rpc_msg
+	req.Xdr(rd)
+	err := rd.Error()
+	if err != nil {
+		return err
+	}
+	if req.Body.Mtype != rfc1057.CALL {
+		return fmt.Errorf("request mtype %d != CALL", req.Body.Mtype)
+	}
+
+	var res rfc1057.Rpc_msg
+	var resdata xdr.Xdrable
+	res.Xid = req.Xid
+	res.Body.Mtype = rfc1057.REPLY
+
+	cbody := req.Body.Cbody
+	cred, ok := DecodeCred(cbody.Cred)
+	if cbody.Rpcvers != 2 {
+		res.Body.Rbody.Stat = rfc1057.MSG_DENIED
+		res.Body.Rbody.Rreply.Stat = rfc1057.RPC_MISMATCH
+	} else if !ok {
+		res.Body.Rbody.Stat = rfc1057.MSG_DENIED
+		res.Body.Rbody.Rreply.Stat = rfc1057.AUTH_ERROR
+		res.Body.Rbody.Rreply.Astat = rfc1057.AUTH_BADCRED
+	} else {
+		res.Body.Rbody.Stat = rfc1057.MSG_ACCEPTED
+		var stat rfc1057.Accept_stat
+		resdata, stat = srv.call(cbody.Prog, cbody.Vers, cbody.Proc, cred, rd)
+		res.Body.Rbody.Areply.Reply_data.Stat = stat
+	}
+
+	// Reserve 4 bytes at the front for the length
+	var reserveLen [4]byte
+	wr := xdr.MakeWriter(reserveLen[:])
+	res.Xdr(wr)
+	if res.Body.Rbody.Areply.Reply_data.Stat == rfc1057.SUCCESS && resdata != nil {
+		resdata.Xdr(wr)
+	}
+	err = wr.Error()
+	if err != nil {
+		return err
+	}
+	wbuf := wr.WriteBuf()
+	binary.BigEndian.PutUint32(wbuf[0:4], (1<<31)|uint32(len(wbuf)-4))
+	_, err = w.Write(wbuf)
+	return err
+}
@@ -3,9 +3,12 @@ package shrinker
 import (
 	"sync"
 
+	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/util"
 	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 type ShrinkerSt struct {
@@ -42,6 +45,9 @@ func (shrinkst *ShrinkerSt) DoShrink(inum common.Inum) bool {
 	var more = true
 	var ok = true
 	for more {
+		if shrinkst.crashed() {
+			break
+		}
 		op := fstxn.Begin(shrinkst.fsstate)
 		ip := op.GetInodeInumFree(inum)
 		if ip == nil {
@@ -53,9 +59,6 @@ func (shrinkst *ShrinkerSt) DoShrink(inum common.Inum) bool {
 		if !ok {
 			break
 		}
-		if shrinkst.crashed() {
-			break
-		}
 	}
 	return ok
 }
@@ -99,3 +102,47 @@ func (shrinkst *ShrinkerSt) shrinker(inum common.Inum) {
 	shrinkst.condShut.Signal()
 	shrinkst.mu.Unlock()
 }
+
+// Scavenge finishes the shrinks that a crash interrupted, and frees the
+// blocks of free inodes that still own some, so that their space
+// doesn't stay lost until an operation runs into them.  It reads the
+// inode table a block at a time without locks, to find the inodes to
+// check under their lock.  It returns the # inodes it shrank and the #
+// blocks that were freed meanwhile, which are the ones it freed if
+// nothing else runs, as when the file system starts.
+func (shrinkst *ShrinkerSt) Scavenge() (uint64, uint64) {
+	st := shrinkst.fsstate
+	_, free := st.Bcount.Counts()
+	var n uint64 = 0
+	for inum := common.Inum(0); inum < st.Super.NInode(); inum += super.INODEBLK {
+		a := st.Super.Inum2Addr(inum)
+		blk := st.Txn.Load(st.Super.Block2addr(a.Blkno), common.NBITBLOCK)
+		for i := common.Inum(0); i < super.INODEBLK; i++ {
+			if inum+i == common.NULLINUM {
+				continue
+			}
+			ip := inode.Decode(buf.MkBufLoad(st.Super.Inum2Addr(inum+i),
+				super.INODESZ*8, blk.Data), inum+i)
+			if ip.NeedsReclaim() && shrinkst.scavenge(inum+i) {
+				n = n + 1
+			}
+		}
+	}
+	_, nfree := st.Bcount.Counts()
+	return n, nfree - free
+}
+
+// scavenge shrinks inode inum, if it needs reclaiming
+func (shrinkst *ShrinkerSt) scavenge(inum common.Inum) bool {
+	op := fstxn.Begin(shrinkst.fsstate)
+	ip := op.GetInodeInumFree(inum)
+	shrink := ip.Reclaim(op.Atxn)
+	if !op.Commit() {
+		return false
+	}
+	if !shrink {
+		return false
+	}
+	util.DPrintf(1, "Scavenge: shrink # %d\n", inum)
+	return shrinkst.DoShrink(inum)
+}
@@ -2,11 +2,25 @@ package super
 
 import (
 	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
 )
 
+const (
+	INODESZ  uint64 = 256 // on-disk size
+	INODEBLK uint64 = disk.BlockSize / INODESZ
+)
+
+// The reserved block records the on-disk format, so that the server
+// refuses a disk with a different layout instead of misreading it.
+// Bump VERSION when the layout changes.
+const (
+	MAGIC   uint64 = 0x6e66736476336673 // "nfsdv3fs"
+	VERSION uint64 = 1
+)
+
 type FsSuper struct {
 	Disk         disk.Disk
 	Size         uint64
@@ -15,6 +29,13 @@ type FsSuper struct {
 	NInodeBitmap uint64
 	nInodeBlk    uint64
 	Maxaddr      uint64
+
+	// if set, new files map their blocks with the inode's blks
+	// instead of an extent tree
+	BlockMap bool
+	// if set, full-block writes to new blocks of EXTENTS files go
+	// directly to disk instead of through the log
+	Bypass bool
 }
 
 func MkFsSuper(d disk.Disk) *FsSuper {
@@ -27,8 +48,10 @@ func MkFsSuper(d disk.Disk) *FsSuper {
 		nLog:         common.LOGSIZE,
 		NBlockBitmap: nblockbitmap,
 		NInodeBitmap: common.NINODEBITMAP,
-		nInodeBlk:    (common.NINODEBITMAP * common.NBITBLOCK * common.INODESZ) / disk.BlockSize,
-		Maxaddr:      sz}
+		nInodeBlk:    (common.NINODEBITMAP * common.NBITBLOCK * INODESZ) / disk.BlockSize,
+		Maxaddr:      sz,
+		BlockMap:     false,
+		Bypass:       false}
 }
 
 func (fs *FsSuper) MaxBnum() common.Bnum {
@@ -47,19 +70,77 @@ func (fs *FsSuper) InodeStart() common.Bnum {
 	return fs.BitmapInodeStart() + common.Bnum(fs.NInodeBitmap)
 }
 
-func (fs *FsSuper) DataStart() common.Bnum {
+// ReservedStart is a block for file-system wide state, such as the
+// boot counter
+func (fs *FsSuper) ReservedStart() common.Bnum {
 	return fs.InodeStart() + common.Bnum(fs.nInodeBlk)
 }
 
+func (fs *FsSuper) DataStart() common.Bnum {
+	return fs.ReservedStart() + 1
+}
+
+// BootAddr is the address of the boot counter in the reserved block
+func (fs *FsSuper) BootAddr() addr.Addr {
+	return addr.MkAddr(fs.ReservedStart(), 0)
+}
+
+// FormatAddr is the address of the magic number, format version, and
+// mkfs state in the reserved block, after the boot counter
+func (fs *FsSuper) FormatAddr() addr.Addr {
+	return addr.MkAddr(fs.ReservedStart(), 64)
+}
+
+// Blank returns whether the disk holds no file system: the first inode
+// block, which holds the root inode in every format, is zero
+func (fs *FsSuper) Blank() bool {
+	blk := fs.Disk.Read(uint64(fs.InodeStart()))
+	for _, b := range blk {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Format returns whether the reserved block holds the magic number and
+// version of this format, and whether mkfs finished
+func (fs *FsSuper) Format() (bool, bool) {
+	blk := fs.Disk.Read(uint64(fs.ReservedStart()))
+	dec := marshal.NewDec(blk[fs.FormatAddr().Off/8:])
+	magic := dec.GetInt()
+	version := dec.GetInt()
+	done := dec.GetInt()
+	return magic == MAGIC && version == VERSION, done == 1
+}
+
+// WriteFormat writes the magic number and version to the reserved
+// block of a new file system, and whether mkfs is done.  mkfs writes
+// it first with done false, so that a crash during mkfs leaves a disk
+// that the next mount formats again instead of refusing it.
+func (fs *FsSuper) WriteFormat(done bool) {
+	blk := make(disk.Block, disk.BlockSize)
+	enc := marshal.NewEnc(24)
+	enc.PutInt(MAGIC)
+	enc.PutInt(VERSION)
+	if done {
+		enc.PutInt(1)
+	} else {
+		enc.PutInt(0)
+	}
+	copy(blk[fs.FormatAddr().Off/8:], enc.Finish())
+	fs.Disk.Write(uint64(fs.ReservedStart()), blk)
+}
+
 func (fs *FsSuper) Block2addr(blkno common.Bnum) addr.Addr {
 	return addr.MkAddr(blkno, 0)
 }
 
 func (fs *FsSuper) NInode() common.Inum {
-	return common.Inum(fs.nInodeBlk * common.INODEBLK)
+	return common.Inum(fs.nInodeBlk * INODEBLK)
 }
 
 func (fs *FsSuper) Inum2Addr(inum common.Inum) addr.Addr {
-	return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/common.INODEBLK),
-		(uint64(inum)%common.INODEBLK)*common.INODESZ*8)
+	return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/INODEBLK),
+		(uint64(inum)%INODEBLK)*INODESZ*8)
 }